@@ -0,0 +1,157 @@
+package pukcab
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"os"
+	"path"
+	"sync"
+)
+
+// ArtifactWriter writes a backup artifact to a temporary file that is only renamed into place once the artifact is
+// committed. A failed or aborted artifact never replaces an existing file with the same name.
+//
+// Data written to the ArtifactWriter is checksummed as it is written. Modules that run external programs can instead
+// have the program write to the path returned by TempPath, and the checksum is calculated when the artifact is committed.
+type ArtifactWriter struct {
+	filePath string
+	f        *os.File
+	hash     hash.Hash
+	size     uint64
+	done     bool
+	lock     sync.Mutex
+}
+
+// CreateArtifact will create a new artifact with the given file name in the run directory of the module instance.
+// The caller must call either Commit or Abort on the returned writer.
+func CreateArtifact(instance *Instance, fileName string) (*ArtifactWriter, error) {
+	if IsDryRun() {
+		return nil, fmt.Errorf("artifacts can't be created during a dry run")
+	}
+	w, err := newArtifactWriter(GetFilePath(instance, fileName))
+	if err != nil {
+		return nil, err
+	}
+	if err := instance.trackWriter(w); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func newArtifactWriter(filePath string) (*ArtifactWriter, error) {
+	f, err := os.CreateTemp(path.Dir(filePath), TempPattern(filePath))
+	if err != nil {
+		log.PError("Error creating temporary file", map[string]interface{}{
+			"file_path": filePath,
+			"error":     err.Error(),
+		})
+		return nil, err
+	}
+
+	return &ArtifactWriter{
+		filePath: filePath,
+		f:        f,
+		hash:     sha256.New(),
+	}, nil
+}
+
+// Path returns the path where the artifact will be saved once committed
+func (w *ArtifactWriter) Path() string {
+	return w.filePath
+}
+
+// TempPath returns the path of the temporary file that the artifact is written to
+func (w *ArtifactWriter) TempPath() string {
+	return w.f.Name()
+}
+
+// Write writes data to the artifact
+func (w *ArtifactWriter) Write(p []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.done {
+		return 0, fmt.Errorf("artifact already committed or aborted")
+	}
+	n, err := w.f.Write(p)
+	w.hash.Write(p[:n])
+	w.size += uint64(n)
+	return n, err
+}
+
+// Commit will flush the artifact to disk and rename it into place, replacing any existing file with the same name
+func (w *ArtifactWriter) Commit() (*File, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.done {
+		return nil, fmt.Errorf("artifact already committed or aborted")
+	}
+	w.done = true
+	tmpPath := w.f.Name()
+
+	fail := func(err error) (*File, error) {
+		log.PError("Error saving artifact", map[string]interface{}{
+			"file_path": w.filePath,
+			"error":     err.Error(),
+		})
+		w.f.Close()
+		os.Remove(tmpPath)
+		return nil, err
+	}
+
+	if err := w.f.Sync(); err != nil {
+		return fail(err)
+	}
+	if err := w.f.Chmod(0644); err != nil {
+		return fail(err)
+	}
+	info, err := w.f.Stat()
+	if err != nil {
+		return fail(err)
+	}
+	if err := w.f.Close(); err != nil {
+		os.Remove(tmpPath)
+		return nil, err
+	}
+
+	checksum := hex.EncodeToString(w.hash.Sum(nil))
+	if uint64(info.Size()) != w.size {
+		// The artifact was written by something other than this writer
+		checksum, err = hashFile(tmpPath)
+		if err != nil {
+			os.Remove(tmpPath)
+			return nil, err
+		}
+	}
+
+	if err := os.Rename(tmpPath, w.filePath); err != nil {
+		log.PError("Error renaming temporary file", map[string]interface{}{
+			"file_path": w.filePath,
+			"error":     err.Error(),
+		})
+		os.Remove(tmpPath)
+		return nil, err
+	}
+
+	return &File{
+		Path:   w.filePath,
+		Size:   uint64(info.Size()),
+		SHA256: checksum,
+	}, nil
+}
+
+// Abort will discard the artifact. It is safe to call Abort after Commit, in which case it does nothing.
+func (w *ArtifactWriter) Abort() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.done {
+		return nil
+	}
+	w.done = true
+	w.f.Close()
+	return os.Remove(w.f.Name())
+}
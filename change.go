@@ -0,0 +1,187 @@
+package pukcab
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// What happens to artifacts that are unchanged since the previous run
+const (
+	// Keep unchanged artifacts and mark them as unchanged in the run result and manifest
+	UnchangedRecord = "record"
+	// Remove unchanged artifacts, the previous copy is kept instead
+	UnchangedDiscard = "discard"
+	// Don't compare artifacts, used to turn off change detection for a module when it is set globally
+	UnchangedNone = "none"
+)
+
+// ChangeDetectionConfig describes how artifacts are compared with the artifacts from the previous run of the module
+// instance
+type ChangeDetectionConfig struct {
+	// What happens to artifacts that are unchanged, such as "discard". Defaults to "record".
+	Unchanged string `json:"unchanged"`
+	// Optional command and arguments that are run for each artifact that changed
+	OnChange []string `json:"on_change"`
+}
+
+// changeDetectionConfig returns the change detection config for the module instance, or nil if artifacts are not
+// compared
+func changeDetectionConfig(instance ModuleType) *ChangeDetectionConfig {
+	config := pukcabConfig.ChangeDetection
+	if instance.ChangeDetection != nil {
+		config = instance.ChangeDetection
+	}
+	if config == nil || config.Unchanged == UnchangedNone {
+		return nil
+	}
+	return config
+}
+
+// validateChangeDetection checks a change detection config for problems
+func validateChangeDetection(label string, config ChangeDetectionConfig) ConfigErrors {
+	errs := ConfigErrors{}
+	switch config.Unchanged {
+	case "", UnchangedRecord, UnchangedDiscard, UnchangedNone:
+	default:
+		errs = append(errs, FieldError{label, "change_detection.unchanged", fmt.Sprintf("'%s' is not a known option", config.Unchanged)})
+	}
+	if config.OnChange != nil && (len(config.OnChange) == 0 || config.OnChange[0] == "") {
+		errs = append(errs, FieldError{label, "change_detection.on_change", "must start with the command to run"})
+	}
+	return errs
+}
+
+// previousArtifact describes the most recent copy of an artifact saved by an earlier run
+type previousArtifact struct {
+	// The run directory the artifact was saved to
+	Dir  string
+	File ManifestFile
+}
+
+// Path returns the path of the previous artifact
+func (a previousArtifact) Path() string {
+	if path.IsAbs(a.File.Name) {
+		return a.File.Name
+	}
+	return path.Join(a.Dir, a.File.Name)
+}
+
+// previousArtifacts returns the most recent saved copy of each artifact from earlier runs of the module instance, keyed
+// by the name of the artifact. Returns nil if the instance has never run.
+func previousArtifacts(module ContextModule, instance ModuleType) (map[string]previousArtifact, error) {
+	runs, err := SavedRuns(module, instance)
+	if err != nil {
+		return nil, err
+	}
+	return latestArtifacts(runs), nil
+}
+
+// latestArtifacts returns the most recent copy of each artifact saved by the given runs, which must be sorted oldest
+// first, keyed by the name of the artifact. Returns nil if there are no runs.
+func latestArtifacts(runs []SavedRun) map[string]previousArtifact {
+	if len(runs) == 0 {
+		return nil
+	}
+
+	// Later runs replace earlier copies
+	previous := map[string]previousArtifact{}
+	for _, run := range runs {
+		for _, file := range run.Files {
+			previous[file.Name] = previousArtifact{Dir: run.Dir, File: file}
+		}
+	}
+	return previous
+}
+
+// contentChecksum returns the checksum of the content of an artifact, which for encrypted artifacts is the checksum
+// before it was encrypted since encrypting the same content twice never produces the same file
+func contentChecksum(checksum string, encryption *ArtifactEncryption) string {
+	if encryption != nil {
+		return encryption.PlainSHA256
+	}
+	return checksum
+}
+
+// detectChange compares the processed artifact, which is the first of artifacts, with the previous copy of the
+// artifact. Returns the artifacts to keep, which is nil if the artifact was unchanged and discarded. Any other
+// artifacts saved by processors are kept or discarded along with it.
+func detectChange(ctx context.Context, config ChangeDetectionConfig, instance *Instance, previous map[string]previousArtifact, artifacts []Artifact) []Artifact {
+	artifact := artifacts[0]
+	name, err := filepath.Rel(instance.Dir, artifact.Path)
+	if err != nil || strings.HasPrefix(name, "..") {
+		name = artifact.Path
+	}
+
+	prev, ok := previous[name]
+	if ok && contentChecksum(prev.File.SHA256, prev.File.Encryption) == contentChecksum(artifact.SHA256, artifact.Encryption) {
+		// The previous copy in the same run directory has already been replaced, so it can't be kept instead
+		if config.Unchanged == UnchangedDiscard && prev.Dir != instance.Dir {
+			instance.Log.PInfo("Discarding unchanged artifact", map[string]interface{}{
+				"file_path":     artifact.Path,
+				"previous_path": prev.Path(),
+			})
+			for _, a := range artifacts {
+				os.Remove(a.Path)
+			}
+			return nil
+		}
+		instance.Log.PInfo("Artifact unchanged", map[string]interface{}{
+			"file_path":     artifact.Path,
+			"previous_path": prev.Path(),
+		})
+		artifacts[0].Unchanged = true
+		return artifacts
+	}
+
+	instance.Log.PInfo("Artifact changed", map[string]interface{}{
+		"file_path": artifact.Path,
+		"new":       !ok,
+	})
+	artifacts[0].Changed = true
+	if len(config.OnChange) > 0 {
+		var p *previousArtifact
+		if ok {
+			p = &prev
+		}
+		runChangeHook(ctx, config.OnChange, instance, artifacts[0], p)
+	}
+	return artifacts
+}
+
+// runChangeHook runs the on change command for a changed artifact. The command is given details of the artifact in
+// environment variables. A failed command is logged but doesn't fail the module.
+func runChangeHook(ctx context.Context, command []string, instance *Instance, artifact Artifact, previous *previousArtifact) {
+	env := append(os.Environ(),
+		"PUKCAB_MODULE="+instance.Module,
+		"PUKCAB_INSTANCE="+instance.Label,
+		"PUKCAB_RUN_ID="+runID,
+		"PUKCAB_FILE="+artifact.Path,
+		"PUKCAB_SHA256="+contentChecksum(artifact.SHA256, artifact.Encryption),
+	)
+	if previous != nil {
+		env = append(env, "PUKCAB_PREVIOUS_SHA256="+contentChecksum(previous.File.SHA256, previous.File.Encryption))
+		// The previous copy is only still there if it was saved to a different run directory
+		if previous.Dir != instance.Dir {
+			if _, err := os.Stat(previous.Path()); err == nil {
+				env = append(env, "PUKCAB_PREVIOUS_FILE="+previous.Path())
+			}
+		}
+	}
+
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+	cmd.Env = env
+	out, err := cmd.CombinedOutput()
+	instance.Log.Debug("on_change output: %s", out)
+	if err != nil {
+		instance.Log.PError("Error running on_change command", map[string]interface{}{
+			"file_path": artifact.Path,
+			"command":   command[0],
+			"error":     err.Error(),
+		})
+	}
+}
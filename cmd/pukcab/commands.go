@@ -0,0 +1,428 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"path"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ecnepsnai/logtic"
+	"github.com/ecnepsnai/pukcab"
+)
+
+func runCommand(args []string) int {
+	flags, opts := newFlagSet("run", true)
+	flags.BoolVar(&opts.DryRun, "dry-run", false, "Show what would be saved and removed without changing anything")
+	positional, exitCode := parseArgs(flags, args, 1, 1)
+	if exitCode != noExit {
+		return exitCode
+	}
+	config, exitCode := configure(positional[0], opts)
+	if exitCode != noExit {
+		return exitCode
+	}
+	modules, err := selectModules(config, opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		return exitUsage
+	}
+
+	// Stop any running modules and skip remaining modules when interrupted
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	destinations, exitCode := openDestinations(ctx, config, "")
+	if exitCode != noExit {
+		return exitCode
+	}
+
+	moduleMap := getModuleMap()
+	jobs := make([]pukcab.Job, len(modules))
+	for i, module := range modules {
+		jobs[i] = pukcab.Job{
+			Module:       moduleMap[module.Name],
+			Instance:     module,
+			Destinations: destinations,
+		}
+	}
+	results := pukcab.RunJobs(ctx, jobs)
+
+	nFailed := printResults(results)
+	if ctx.Err() != nil {
+		return exitInterrupted
+	}
+	if nFailed > 0 {
+		return exitFailed
+	}
+	return exitOK
+}
+
+func checkCommand(args []string) int {
+	flags, opts := newFlagSet("check", false)
+	positional, exitCode := parseArgs(flags, args, 1, 1)
+	if exitCode != noExit {
+		return exitCode
+	}
+	if _, exitCode := loadConfig(positional[0], opts); exitCode != noExit {
+		return exitCode
+	}
+	fmt.Println("Config OK")
+	return exitOK
+}
+
+func listModulesCommand(args []string) int {
+	flags, opts := newFlagSet("list-modules", true)
+	positional, exitCode := parseArgs(flags, args, 0, 1)
+	if exitCode != noExit {
+		return exitCode
+	}
+
+	if len(positional) == 0 {
+		for _, module := range pukcabModules {
+			fmt.Println(module.Name())
+		}
+		return exitOK
+	}
+
+	config, exitCode := loadConfig(positional[0], opts)
+	if exitCode != noExit {
+		return exitCode
+	}
+	modules, err := selectModules(config, opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		return exitUsage
+	}
+
+	moduleMap := getModuleMap()
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tMODULE\tHOST\tTAGS")
+	for _, module := range modules {
+		host := ""
+		if hostModule, ok := moduleMap[module.Name].(pukcab.HostModule); ok {
+			host = hostModule.Host(module.Config)
+		}
+		if host == "" {
+			host = "-"
+		}
+		tags := "-"
+		if len(module.Tags) > 0 {
+			tags = strings.Join(module.Tags, ",")
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", module.Label(), module.Name, host, tags)
+	}
+	w.Flush()
+	return exitOK
+}
+
+func cleanupCommand(args []string) int {
+	flags, opts := newFlagSet("cleanup", true)
+	flags.BoolVar(&opts.DryRun, "dry-run", false, "Show what would be removed without changing anything")
+	positional, exitCode := parseArgs(flags, args, 1, 1)
+	if exitCode != noExit {
+		return exitCode
+	}
+	config, exitCode := configure(positional[0], opts)
+	if exitCode != noExit {
+		return exitCode
+	}
+	modules, err := selectModules(config, opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		return exitUsage
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	destinations, exitCode := openDestinations(ctx, config, "")
+	if exitCode != noExit {
+		return exitCode
+	}
+
+	moduleMap := getModuleMap()
+	exitCode = exitOK
+	for _, module := range modules {
+		removed, err := pukcab.CleanupModule(moduleMap[module.Name], module)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "FAIL %s: %s\n", module.Label(), err.Error())
+			exitCode = exitError
+			continue
+		}
+		for _, destination := range destinations {
+			destinationRemoved, err := pukcab.CleanupDestination(ctx, destination, moduleMap[module.Name], module)
+			removed = append(removed, prefixKeys(destination.Label, destinationRemoved)...)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "FAIL %s: destination %s: %s\n", module.Label(), destination.Label, err.Error())
+				exitCode = exitError
+			}
+		}
+		if opts.DryRun {
+			fmt.Printf("PLAN %s: %d run(s) would be removed\n", module.Label(), len(removed))
+		} else {
+			fmt.Printf("OK   %s: %d run(s) removed\n", module.Label(), len(removed))
+		}
+		printRemoved(removed, opts.DryRun)
+	}
+	if ctx.Err() != nil {
+		return exitInterrupted
+	}
+	return exitCode
+}
+
+func verifyCommand(args []string) int {
+	flags, opts := newFlagSet("verify", false)
+	positional, exitCode := parseArgs(flags, args, 1, 1)
+	if exitCode != noExit {
+		return exitCode
+	}
+	if _, exitCode := configure(positional[0], opts); exitCode != noExit {
+		return exitCode
+	}
+
+	reports, err := pukcab.Verify()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error verifying artifacts: %s\n", err.Error())
+		return exitError
+	}
+
+	exitCode = exitOK
+	for _, report := range reports {
+		if report.OK() {
+			fmt.Printf("OK   %s: %d artifact(s) verified\n", report.Module, report.Checked)
+			continue
+		}
+
+		exitCode = exitFailed
+		fmt.Fprintf(os.Stderr, "FAIL %s: %d artifact(s) checked, %d missing, %d altered, %d orphaned\n", report.Module, report.Checked, len(report.Missing), len(report.Altered), len(report.Orphaned))
+		for _, filePath := range report.Missing {
+			fmt.Fprintf(os.Stderr, "     missing %s\n", filePath)
+		}
+		for _, filePath := range report.Altered {
+			fmt.Fprintf(os.Stderr, "     altered %s\n", filePath)
+		}
+		for _, filePath := range report.Orphaned {
+			fmt.Fprintf(os.Stderr, "     orphaned %s\n", filePath)
+		}
+	}
+	return exitCode
+}
+
+func restoreCommand(args []string) int {
+	flags, opts := newFlagSet("restore", false)
+	runDir := flags.String("run", "", "The name of the run directory to restore from. Defaults to the most recent successful run.")
+	from := flags.String("from", "", "The id of a destination to restore from instead of the output directory")
+	positional, exitCode := parseArgs(flags, args, 3, 3)
+	if exitCode != noExit {
+		return exitCode
+	}
+	config, exitCode := configure(positional[0], opts)
+	if exitCode != noExit {
+		return exitCode
+	}
+
+	opts.Only = stringList{positional[1]}
+	modules, err := selectModules(config, opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		return exitUsage
+	}
+	if len(modules) > 1 {
+		fmt.Fprintf(os.Stderr, "'%s' matches %d modules, use the id of the module instead\n", positional[1], len(modules))
+		return exitUsage
+	}
+	module := modules[0]
+
+	var restored []string
+	if *from != "" {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		destinations, exitCode := openDestinations(ctx, config, *from)
+		if exitCode != noExit {
+			return exitCode
+		}
+		restored, err = pukcab.RestoreFrom(ctx, destinations[0], getModuleMap()[module.Name], module, *runDir, positional[2])
+	} else {
+		restored, err = pukcab.Restore(getModuleMap()[module.Name], module, *runDir, positional[2])
+	}
+	for _, filePath := range restored {
+		fmt.Printf("Restored %s\n", filePath)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error restoring %s: %s\n", module.Label(), err.Error())
+		return exitError
+	}
+	return exitOK
+}
+
+func statusCommand(args []string) int {
+	flags, opts := newFlagSet("status", true)
+	positional, exitCode := parseArgs(flags, args, 1, 1)
+	if exitCode != noExit {
+		return exitCode
+	}
+	config, exitCode := configure(positional[0], opts)
+	if exitCode != noExit {
+		return exitCode
+	}
+	modules, err := selectModules(config, opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		return exitUsage
+	}
+
+	moduleMap := getModuleMap()
+	exitCode = exitOK
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tMODULE\tRUNS\tLAST RUN\tSTATUS\tARTIFACTS\tLAST SUCCESS")
+	for _, module := range modules {
+		status, err := pukcab.Status(moduleMap[module.Name], module)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading status of %s: %s\n", module.Label(), err.Error())
+			exitCode = exitError
+			continue
+		}
+
+		lastRun, result, nFiles, lastSuccess := "never", "-", "-", "never"
+		if status.LastRun != nil {
+			lastRun = status.LastRun.Start.Format(time.RFC3339)
+			result = "OK"
+			if !status.LastRun.OK() {
+				result = "FAIL"
+				if exitCode == exitOK {
+					exitCode = exitFailed
+				}
+			}
+			nFiles = fmt.Sprintf("%d", status.LastRunArtifacts)
+		}
+		if status.LastSuccess != nil {
+			lastSuccess = status.LastSuccess.Start.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s\t%s\n", status.Instance, status.Module, status.Runs, lastRun, result, nFiles, lastSuccess)
+	}
+	w.Flush()
+	return exitCode
+}
+
+func decryptCommand(args []string) int {
+	flags, opts := newFlagSet("decrypt", false)
+	decryptOptions := pukcab.DecryptOptions{}
+	flags.StringVar(&decryptOptions.IdentityFile, "identity", "", "The age identity file to decrypt with. Required for age encrypted artifacts.")
+	flags.StringVar(&decryptOptions.GPGPath, "gpg-path", "", "The gpg binary to decrypt OpenPGP encrypted artifacts with. Defaults to gpg in $PATH.")
+	flags.StringVar(&decryptOptions.GPGHome, "gpg-home", "", "The gpg home directory containing the secret key")
+	positional, exitCode := parseArgs(flags, args, 1, 2)
+	if exitCode != noExit {
+		return exitCode
+	}
+	if opts.Verbose {
+		logtic.Log.Level = logtic.LevelDebug
+	}
+	if opts.LogFile != "" {
+		logtic.Log.FilePath = opts.LogFile
+	}
+	if exitCode := openLog(); exitCode != noExit {
+		return exitCode
+	}
+
+	filePath := positional[0]
+	targetPath := strings.TrimSuffix(filePath, path.Ext(filePath))
+	if len(positional) > 1 {
+		targetPath = positional[1]
+	} else if targetPath == filePath || path.Ext(filePath) == "" {
+		fmt.Fprintf(os.Stderr, "An output file is required for %s\n", filePath)
+		return exitUsage
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := pukcab.DecryptArtifact(ctx, filePath, targetPath, decryptOptions); err != nil {
+		fmt.Fprintf(os.Stderr, "Error decrypting %s: %s\n", filePath, err.Error())
+		if ctx.Err() != nil {
+			return exitInterrupted
+		}
+		return exitError
+	}
+	fmt.Printf("Decrypted %s\n", targetPath)
+	return exitOK
+}
+
+// printResults prints a summary of each module run and returns the number of failed runs
+func printResults(results []*pukcab.RunResult) int {
+	nFailed := 0
+	for _, result := range results {
+		if result.DryRun && !result.Failed() {
+			fmt.Printf("PLAN %s: %d artifact(s) would be saved to %s\n", result.Instance, len(result.Planned), result.Dir)
+			for _, artifact := range result.Planned {
+				line := "     save " + artifact.Path
+				if artifact.Source != "" {
+					line += " from " + artifact.Source
+				}
+				if artifact.Size > 0 {
+					line += fmt.Sprintf(" (%d bytes)", artifact.Size)
+				}
+				fmt.Println(line)
+			}
+			printRemoved(result.Expired, true)
+			for _, destination := range result.Destinations {
+				printRemoved(prefixKeys(destination.Destination, destination.Expired), true)
+			}
+			continue
+		}
+		if !result.Failed() {
+			unchanged := len(result.Skipped)
+			for _, artifact := range result.Artifacts {
+				if artifact.Unchanged {
+					unchanged++
+				}
+			}
+			if unchanged > 0 {
+				fmt.Printf("OK   %s: %d artifact(s), %d unchanged in %s\n", result.Instance, len(result.Artifacts), unchanged, result.Duration().Round(time.Millisecond))
+			} else {
+				fmt.Printf("OK   %s: %d artifact(s) in %s\n", result.Instance, len(result.Artifacts), result.Duration().Round(time.Millisecond))
+			}
+			for _, destination := range result.Destinations {
+				fmt.Printf("     copied %d file(s) to %s\n", len(destination.Uploaded), destination.Destination)
+			}
+			continue
+		}
+
+		nFailed++
+		fmt.Fprintf(os.Stderr, "FAIL %s: %d artifact(s), %d discarded in %s\n", result.Instance, len(result.Artifacts), len(result.Discarded), result.Duration().Round(time.Millisecond))
+		if result.Error != nil {
+			fmt.Fprintf(os.Stderr, "     error: %s\n", result.Error.Error())
+		}
+		for _, discarded := range result.Discarded {
+			fmt.Fprintf(os.Stderr, "     discarded %s: %s\n", discarded.Path, discarded.Reason)
+		}
+		for _, destination := range result.Destinations {
+			if destination.Error != nil {
+				fmt.Fprintf(os.Stderr, "     error: %s\n", destination.Error.Error())
+			}
+		}
+	}
+	return nFailed
+}
+
+// printRemoved prints the run directories that were removed by a cleanup
+func printRemoved(removed []string, dryRun bool) {
+	for _, dirPath := range removed {
+		if dryRun {
+			fmt.Printf("     remove %s\n", dirPath)
+		} else {
+			fmt.Printf("     removed %s\n", dirPath)
+		}
+	}
+}
+
+// prefixKeys returns the keys prefixed with the label of their destination
+func prefixKeys(label string, keys []string) []string {
+	prefixed := make([]string, len(keys))
+	for i, key := range keys {
+		prefixed[i] = label + ":" + key
+	}
+	return prefixed
+}
@@ -1,12 +1,19 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"os"
+	"strings"
 
 	"github.com/ecnepsnai/logtic"
 	"github.com/ecnepsnai/pukcab"
+	"github.com/ecnepsnai/pukcab/destinations/local"
+	"github.com/ecnepsnai/pukcab/destinations/s3"
+	"github.com/ecnepsnai/pukcab/destinations/sftp"
+	"github.com/ecnepsnai/pukcab/destinations/webdav"
 	"github.com/ecnepsnai/pukcab/modules/cloudflare"
 	"github.com/ecnepsnai/pukcab/modules/cmd"
 	httpModule "github.com/ecnepsnai/pukcab/modules/http"
@@ -15,7 +22,7 @@ import (
 	"github.com/ecnepsnai/pukcab/modules/tar"
 )
 
-var pukcabModules = []pukcab.Module{
+var pukcabModules = []pukcab.ContextModule{
 	pfsense.PFSenseModule{},
 	cloudflare.CloudflareModule{},
 	tar.TarModule{},
@@ -24,43 +31,315 @@ var pukcabModules = []pukcab.Module{
 	cmd.CmdModule{},
 }
 
+var pukcabDestinations = []pukcab.DestinationProvider{
+	local.LocalProvider{},
+	s3.S3Provider{},
+	sftp.SFTPProvider{},
+	webdav.WebDAVProvider{},
+}
+
+// Exit codes
+const (
+	exitOK = 0
+	// A module failed, or a problem was found with saved artifacts
+	exitFailed = 1
+	// The command line arguments were not valid
+	exitUsage = 2
+	// The config file could not be read or was not valid
+	exitInvalidConfig = 3
+	// An error prevented the command from finishing
+	exitError = 4
+	// Pukcab was stopped by SIGINT or SIGTERM
+	exitInterrupted = 130
+)
+
+// noExit is returned by helpers in place of an exit code when the command should continue
+const noExit = -1
+
+type command struct {
+	Name        string
+	Args        string
+	Description string
+	Run         func(args []string) int
+}
+
+var commands []command
+
+func init() {
+	// Commands are set in init because their flag sets refer back to this list for the usage text
+	commands = []command{
+		{"run", "<config file>", "Run modules and clean up expired artifacts", runCommand},
+		{"check", "<config file>", "Check a config file for problems without running anything", checkCommand},
+		{"list-modules", "[config file]", "List the available modules, or the modules in a config file", listModulesCommand},
+		{"cleanup", "<config file>", "Clean up expired artifacts without running modules", cleanupCommand},
+		{"verify", "<config file>", "Check saved artifacts against their manifests", verifyCommand},
+		{"restore", "<config file> <module|id> <target dir>", "Copy the artifacts from a saved run to a directory", restoreCommand},
+		{"status", "<config file>", "Show the most recent run of each module", statusCommand},
+		{"decrypt", "<encrypted file> [output file]", "Decrypt an encrypted artifact", decryptCommand},
+	}
+}
+
 func main() {
-	if len(os.Args) != 2 {
-		fmt.Fprintf(os.Stderr, "Usage: %s <Path to config JSON>\n", os.Args[0])
-		os.Exit(1)
+	os.Exit(runMain(os.Args[1:]))
+}
+
+func runMain(args []string) int {
+	if len(args) == 0 {
+		printUsage()
+		return exitUsage
+	}
+	switch args[0] {
+	case "help", "-h", "-help", "--help":
+		printUsage()
+		return exitOK
+	}
+
+	for _, c := range commands {
+		if c.Name == args[0] {
+			return c.Run(args[1:])
+		}
+	}
+
+	// Pukcab used to accept only the path to a config file
+	if _, err := os.Stat(args[0]); err == nil && !strings.HasPrefix(args[0], "-") {
+		return runCommand(args)
+	}
+
+	fmt.Fprintf(os.Stderr, "Unknown command '%s'\n\n", args[0])
+	printUsage()
+	return exitUsage
+}
+
+func printUsage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s <command> [options] <arguments>\n\nCommands:\n", os.Args[0])
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-13s %s\n", c.Name, c.Description)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun '%s <command> -h' for the options of a command.\n", os.Args[0])
+}
+
+// options describes the options shared by commands
+type options struct {
+	Only    stringList
+	Skip    stringList
+	Tags    stringList
+	Verbose bool
+	LogFile string
+	DryRun  bool
+}
+
+// stringList is a flag that can be repeated, and whose values can be separated by commas
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*l = append(*l, v)
+		}
+	}
+	return nil
+}
+
+// newFlagSet returns a flag set for the named command with the logging options, and the module selection options if
+// selection is true
+func newFlagSet(name string, selection bool) (*flag.FlagSet, *options) {
+	opts := &options{}
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.BoolVar(&opts.Verbose, "verbose", false, "Log debug messages")
+	flags.StringVar(&opts.LogFile, "log-file", "", "Also write log messages to this file")
+	if selection {
+		flags.Var(&opts.Only, "only", "Only include modules with this name, id, or tag=<tag>. Can be repeated.")
+		flags.Var(&opts.Tags, "tag", "Only include modules with this tag. Can be repeated.")
+		flags.Var(&opts.Skip, "skip", "Exclude modules with this name, id, or tag=<tag>. Can be repeated.")
+	}
+	flags.Usage = func() {
+		for _, c := range commands {
+			if c.Name == name {
+				fmt.Fprintf(os.Stderr, "Usage: %s %s [options] %s\n\n%s.\n\nOptions:\n", os.Args[0], c.Name, c.Args, c.Description)
+			}
+		}
+		flags.PrintDefaults()
+	}
+	return flags, opts
+}
+
+// parseArgs parses the options in args, which may appear before or after the positional arguments, and returns the
+// positional arguments. Returns an exit code if the arguments were not valid or the help was shown, otherwise noExit.
+func parseArgs(flags *flag.FlagSet, args []string, minArgs, maxArgs int) ([]string, int) {
+	positional := []string{}
+	for {
+		if err := flags.Parse(args); err != nil {
+			if errors.Is(err, flag.ErrHelp) {
+				return nil, exitOK
+			}
+			return nil, exitUsage
+		}
+		args = flags.Args()
+		if len(args) == 0 {
+			break
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
 	}
 
-	configFilePath := os.Args[1]
-	f, err := os.OpenFile(configFilePath, os.O_RDONLY, 0644)
+	if len(positional) < minArgs || len(positional) > maxArgs {
+		flags.Usage()
+		return nil, exitUsage
+	}
+	return positional, noExit
+}
+
+func getModuleMap() map[string]pukcab.ContextModule {
+	moduleMap := map[string]pukcab.ContextModule{}
+	for _, module := range pukcabModules {
+		moduleMap[module.Name()] = module
+	}
+	return moduleMap
+}
+
+func getDestinationMap() map[string]pukcab.DestinationProvider {
+	destinationMap := map[string]pukcab.DestinationProvider{}
+	for _, provider := range pukcabDestinations {
+		destinationMap[provider.Name()] = provider
+	}
+	return destinationMap
+}
+
+// loadConfig reads and validates the config file and prepares logging. Returns an exit code if there were any
+// problems with the config file, otherwise noExit.
+func loadConfig(configFilePath string, opts *options) (*pukcab.Config, int) {
+	if opts.Verbose {
+		logtic.Log.Level = logtic.LevelDebug
+	}
+	if opts.LogFile != "" {
+		logtic.Log.FilePath = opts.LogFile
+	}
+
+	config, err := pukcab.LoadConfig(configFilePath)
 	if err != nil {
-		panic(err)
+		fmt.Fprintf(os.Stderr, "Invalid config file %s\n", err.Error())
+		return nil, exitInvalidConfig
 	}
-	defer f.Close()
-	config := pukcab.Config{}
-	if err := json.NewDecoder(f).Decode(&config); err != nil {
-		panic(err)
+
+	if err := pukcab.ValidateConfig(*config, getModuleMap(), getDestinationMap()); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid config file %s:\n", configFilePath)
+		if errs, ok := err.(pukcab.ConfigErrors); ok {
+			for _, err := range errs {
+				fmt.Fprintf(os.Stderr, "  %s\n", err.Error())
+			}
+		} else {
+			fmt.Fprintf(os.Stderr, "  %s\n", err.Error())
+		}
+		return nil, exitInvalidConfig
 	}
 
 	if config.Verbose {
 		logtic.Log.Level = logtic.LevelDebug
 	}
-	logtic.Log.Open()
-	pukcab.Configure(config)
+	if exitCode := openLog(); exitCode != noExit {
+		return nil, exitCode
+	}
+	return config, noExit
+}
 
-	moduleMap := map[string]pukcab.Module{}
-	for _, module := range pukcabModules {
-		moduleMap[module.Name()] = module
+// openLog opens the log file. Returns an exit code if the log file could not be opened, otherwise noExit.
+func openLog() int {
+	if err := logtic.Log.Open(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error opening log file %s: %s\n", logtic.Log.FilePath, err.Error())
+		return exitError
 	}
+	return noExit
+}
 
-	for _, module := range config.Modules {
-		if _, ok := moduleMap[module.Name]; !ok {
-			fmt.Fprintf(os.Stderr, "No module named '%s'\n", module.Name)
-			os.Exit(1)
+// configure loads the config file and prepares pukcab to use it. Returns an exit code if there were any problems,
+// otherwise noExit.
+func configure(configFilePath string, opts *options) (*pukcab.Config, int) {
+	config, exitCode := loadConfig(configFilePath, opts)
+	if config == nil {
+		return nil, exitCode
+	}
+	config.DryRun = opts.DryRun
+	if err := pukcab.Configure(*config); err != nil {
+		fmt.Fprintf(os.Stderr, "Error preparing pukcab: %s\n", err.Error())
+		return nil, exitError
+	}
+	return config, noExit
+}
+
+// openDestinations opens the destinations in the config, or only the destination with the given label if set.
+// Returns an exit code if any destination could not be opened, otherwise noExit.
+func openDestinations(ctx context.Context, config *pukcab.Config, label string) ([]pukcab.OpenDestination, int) {
+	if label != "" {
+		selected := []pukcab.DestinationType{}
+		for _, destination := range config.Destinations {
+			if destination.Label() == label {
+				selected = append(selected, destination)
+			}
 		}
+		if len(selected) == 0 {
+			fmt.Fprintf(os.Stderr, "No destination with id '%s'\n", label)
+			return nil, exitUsage
+		}
+		filtered := *config
+		filtered.Destinations = selected
+		config = &filtered
 	}
 
+	destinations, err := pukcab.OpenDestinations(ctx, *config, getDestinationMap())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error opening destinations: %s\n", err.Error())
+		return nil, exitError
+	}
+	return destinations, noExit
+}
+
+// selectModules returns the modules from the config that match the --only, --tag, and --skip options. Returns an
+// error if any of the options don't match a module.
+func selectModules(config *pukcab.Config, opts *options) ([]pukcab.ModuleType, error) {
+	tagSelectors := make([]string, len(opts.Tags))
+	for i, tag := range opts.Tags {
+		tagSelectors[i] = "tag=" + tag
+	}
+	matches := func(module pukcab.ModuleType, selectors []string) bool {
+		for _, selector := range selectors {
+			if module.Matches(selector) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, selector := range append(append(append([]string{}, opts.Only...), tagSelectors...), opts.Skip...) {
+		found := false
+		for _, module := range config.Modules {
+			if module.Matches(selector) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			if strings.HasPrefix(selector, "tag=") {
+				return nil, fmt.Errorf("no module with tag '%s'", strings.TrimPrefix(selector, "tag="))
+			}
+			return nil, fmt.Errorf("no module with name or id '%s'", selector)
+		}
+	}
+
+	selected := []pukcab.ModuleType{}
 	for _, module := range config.Modules {
-		pukcab.RunModule(moduleMap[module.Name], module.Config)
-		pukcab.CleanupModule(moduleMap[module.Name])
+		if len(opts.Only) > 0 && !matches(module, opts.Only) {
+			continue
+		}
+		if len(tagSelectors) > 0 && !matches(module, tagSelectors) {
+			continue
+		}
+		if matches(module, opts.Skip) {
+			continue
+		}
+		selected = append(selected, module)
 	}
+	return selected, nil
 }
@@ -0,0 +1,200 @@
+package pukcab
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/ecnepsnai/logtic"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// Compression algorithms
+const (
+	// Compress artifacts with gzip
+	CompressionGzip = "gzip"
+	// Compress artifacts with Zstandard
+	CompressionZstd = "zstd"
+	// Compress artifacts with xz
+	CompressionXZ = "xz"
+	// Don't compress artifacts, used to turn off compression for a module when it is set globally
+	CompressionNone = "none"
+)
+
+// CompressionConfig describes how artifacts are compressed after a module saves them
+type CompressionConfig struct {
+	// The compression algorithm, such as "zstd". Defaults to gzip.
+	Algorithm string `json:"algorithm"`
+	// The compression level, from 1 (fastest) to 9 for gzip and xz or 22 for zstd. Defaults to the usual level for the
+	// algorithm.
+	Level int `json:"level"`
+}
+
+// compressionConfig returns the compression config for the module instance, or nil if artifacts are not compressed
+func compressionConfig(instance ModuleType) *CompressionConfig {
+	config := pukcabConfig.Compression
+	if instance.Compression != nil {
+		config = instance.Compression
+	}
+	if config == nil || config.Algorithm == CompressionNone {
+		return nil
+	}
+	return config
+}
+
+// pipelineCompression returns the config of the first compress step in the pipeline, or nil if there isn't one
+func pipelineCompression(pipeline []ProcessorType) *CompressionConfig {
+	for _, step := range pipeline {
+		if step.Name != compressProcessorName {
+			continue
+		}
+		config := CompressionConfig{}
+		if err := MarshallConfig(step.Config, &config); err != nil || config.Algorithm == CompressionNone {
+			return nil
+		}
+		if config.Algorithm == "" {
+			config.Algorithm = CompressionGzip
+		}
+		return &config
+	}
+	return nil
+}
+
+// compressedFileExtension returns the extension added to the name of artifacts compressed with the given algorithm
+func compressedFileExtension(algorithm string) string {
+	switch algorithm {
+	case CompressionZstd:
+		return ".zst"
+	case CompressionXZ:
+		return ".xz"
+	}
+	return ".gz"
+}
+
+// validateCompression checks a compression config for problems. fieldPrefix is added to the name of each field.
+func validateCompression(label string, fieldPrefix string, config CompressionConfig) ConfigErrors {
+	errs := ConfigErrors{}
+	maxLevel := 9
+	switch config.Algorithm {
+	case CompressionNone:
+		return errs
+	case "", CompressionGzip, CompressionXZ:
+	case CompressionZstd:
+		maxLevel = 22
+	default:
+		errs = append(errs, FieldError{label, fieldPrefix + "algorithm", fmt.Sprintf("'%s' is not a known compression algorithm", config.Algorithm)})
+		return errs
+	}
+	if config.Level < 0 || config.Level > maxLevel {
+		errs = append(errs, FieldError{label, fieldPrefix + "level", fmt.Sprintf("must be between 1 and %d", maxLevel)})
+	}
+	return errs
+}
+
+// xzDictionarySizes are the dictionary sizes used for each xz level, which match the presets of the xz command
+var xzDictionarySizes = []int{256 << 10, 1 << 20, 2 << 20, 4 << 20, 4 << 20, 8 << 20, 8 << 20, 16 << 20, 32 << 20, 64 << 20}
+
+// compressWriter returns a writer that compresses data written to it into w. The writer must be closed to flush any
+// remaining data.
+func compressWriter(w io.Writer, config CompressionConfig) (io.WriteCloser, error) {
+	switch config.Algorithm {
+	case "", CompressionGzip:
+		level := config.Level
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		return gzip.NewWriterLevel(w, level)
+	case CompressionZstd:
+		level := zstd.SpeedDefault
+		if config.Level != 0 {
+			level = zstd.EncoderLevelFromZstd(config.Level)
+		}
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(level))
+	case CompressionXZ:
+		level := config.Level
+		if level == 0 {
+			level = 6
+		}
+		xzConfig := xz.WriterConfig{DictCap: xzDictionarySizes[level]}
+		return xzConfig.NewWriter(w)
+	}
+	return nil, fmt.Errorf("'%s' is not a known compression algorithm", config.Algorithm)
+}
+
+// compressProcessor compresses each artifact, replacing the original. Its config is a CompressionConfig.
+type compressProcessor struct{}
+
+func (p compressProcessor) Name() string {
+	return compressProcessorName
+}
+
+func (p compressProcessor) Process(ctx context.Context, instance *Instance, artifact Artifact, c interface{}) ([]Artifact, error) {
+	config := CompressionConfig{}
+	if err := MarshallConfig(c, &config); err != nil {
+		return nil, fmt.Errorf("invalid config for processor: %w", err)
+	}
+	if config.Algorithm == CompressionNone {
+		return []Artifact{artifact}, nil
+	}
+	if config.Algorithm == "" {
+		config.Algorithm = CompressionGzip
+	}
+
+	compressedPath := artifact.Path + compressedFileExtension(config.Algorithm)
+	size, checksum, err := writeProcessedFile(compressedPath, func(w io.Writer) error {
+		f, err := os.Open(artifact.Path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		cw, err := compressWriter(w, config)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(cw, f); err != nil {
+			cw.Close()
+			return err
+		}
+		return cw.Close()
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Remove(artifact.Path); err != nil {
+		return nil, err
+	}
+
+	instance.Log.PInfo("Compressed artifact", map[string]interface{}{
+		"file_path":     compressedPath,
+		"algorithm":     config.Algorithm,
+		"original_size": logtic.FormatBytesB(artifact.Size),
+		"size":          logtic.FormatBytesB(size),
+	})
+	artifact.Path = compressedPath
+	artifact.Size = size
+	artifact.SHA256 = checksum
+	return []Artifact{artifact}, nil
+}
+
+func (p compressProcessor) Plan(instance *Instance, filePath string, c interface{}) ([]string, error) {
+	config := CompressionConfig{}
+	if err := MarshallConfig(c, &config); err != nil {
+		return nil, fmt.Errorf("invalid config for processor: %w", err)
+	}
+	if config.Algorithm == CompressionNone {
+		return []string{filePath}, nil
+	}
+	return []string{filePath + compressedFileExtension(config.Algorithm)}, nil
+}
+
+// Validate checks the processor config for problems
+func (p compressProcessor) Validate(c interface{}) error {
+	config := CompressionConfig{}
+	if err := MarshallConfig(c, &config); err != nil {
+		return fmt.Errorf("%s: %w", compressProcessorName, err)
+	}
+	return validateCompression(compressProcessorName, "", config).Err()
+}
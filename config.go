@@ -1,15 +1,123 @@
 package pukcab
 
+import "strings"
+
 // Config describes a configuration object for pukcab
 type Config struct {
-	Modules           []ModuleType `json:"modules"`
-	OutputDir         string       `json:"output_dir"`
-	Verbose           bool         `json:"verbose"`
-	ArtifactRetention int          `json:"artifact_retention"`
+	Modules           []ModuleType     `json:"modules"`
+	OutputDir         string           `json:"output_dir"`
+	Verbose           bool             `json:"verbose"`
+	ArtifactRetention int              `json:"artifact_retention"`
+	Retention         *RetentionPolicy `json:"retention"`
+	RunLayout         string           `json:"run_layout"`
+	// Optional maximum duration for each module, such as "30m"
+	Timeout string `json:"timeout"`
+	// The number of modules to run at the same time. Defaults to 1.
+	Concurrency int `json:"concurrency"`
+	// The number of modules connecting to the same host to run at the same time. Defaults to no limit.
+	HostConcurrency int `json:"host_concurrency"`
+	// Paths or glob patterns of additional config files whose modules are added to this config. Relative paths are
+	// relative to the directory of this config file.
+	Include []string `json:"include"`
+	// Variables that can be referenced as ${name} in module configs
+	Vars map[string]string `json:"vars"`
+	// Default config for modules, keyed by module name. Values set in the config of a module take precedence.
+	Defaults map[string]map[string]interface{} `json:"defaults"`
+	// Additional locations that artifacts are copied to after each module runs
+	Destinations []DestinationType `json:"destinations"`
+	// Optional encryption for all artifacts
+	Encryption *EncryptionConfig `json:"encryption"`
+	// Optional compression for all artifacts
+	Compression *CompressionConfig `json:"compression"`
+	// Optional processors applied to every artifact, in order
+	Processors []ProcessorType `json:"processors"`
+	// Optional comparison of artifacts with the artifacts from the previous run of each module
+	ChangeDetection *ChangeDetectionConfig `json:"change_detection"`
+	// If true then artifacts that are identical to an artifact saved by an earlier run are replaced with a hard link
+	// to a single copy kept in the store directory
+	Deduplicate bool `json:"deduplicate"`
+	// If true then modules only report what they would save and expired artifacts are not removed. Set by the
+	// --dry-run option rather than the config file.
+	DryRun bool `json:"-"`
 }
 
+// Run directory layouts
+const (
+	// Save artifacts to a directory named by the date of the run, runs on the same day share a directory
+	RunLayoutDate = "date"
+	// Save artifacts to a directory named by the date and time of the run
+	RunLayoutDateTime = "datetime"
+	// Save artifacts to a directory named by the date of the run and the unique ID of the run
+	RunLayoutRunID = "run_id"
+)
+
 // ModuleType describes a module configuration for pukcab
 type ModuleType struct {
 	Name   string      `json:"name"`
 	Config interface{} `json:"config"`
+	// Optional ID used to identify this instance of the module
+	ID string `json:"id"`
+	// Optional retention policy for this module, overrides the global retention policy
+	Retention *RetentionPolicy `json:"retention"`
+	// Optional directory, relative to the output directory, where artifacts for this module are saved. Defaults to the
+	// module name.
+	OutputSubdir string `json:"output_subdir"`
+	// Optional maximum duration for this module, overrides the global timeout
+	Timeout string `json:"timeout"`
+	// Optional tags used to select groups of modules
+	Tags []string `json:"tags"`
+	// Optional encryption for artifacts from this module, overrides the global encryption
+	Encryption *EncryptionConfig `json:"encryption"`
+	// Optional compression for artifacts from this module, overrides the global compression
+	Compression *CompressionConfig `json:"compression"`
+	// Optional processors applied to artifacts from this module, replacing the global processors
+	Processors []ProcessorType `json:"processors"`
+	// Optional change detection for this module, overrides the global change detection
+	ChangeDetection *ChangeDetectionConfig `json:"change_detection"`
+}
+
+// HasTag returns true if the module instance has the given tag
+func (m ModuleType) HasTag(tag string) bool {
+	for _, t := range m.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// Matches returns true if the selector is the name or id of this module instance, or is "tag=<tag>" for one of the
+// tags of this module instance
+func (m ModuleType) Matches(selector string) bool {
+	if strings.HasPrefix(selector, "tag=") {
+		return m.HasTag(strings.TrimPrefix(selector, "tag="))
+	}
+	return m.Name == selector || (m.ID != "" && m.ID == selector)
+}
+
+// Label returns a label identifying this module instance, which is the ID of the instance if set or the module name
+func (m ModuleType) Label() string {
+	if m.ID != "" {
+		return m.ID
+	}
+	return m.Name
+}
+
+// DestinationType describes a destination configuration for pukcab
+type DestinationType struct {
+	// The name of the destination type, such as "local"
+	Name   string      `json:"name"`
+	Config interface{} `json:"config"`
+	// Optional ID used to identify this destination
+	ID string `json:"id"`
+	// Optional retention policy for artifacts at this destination, overrides the retention policy of each module
+	Retention *RetentionPolicy `json:"retention"`
+}
+
+// Label returns a label identifying this destination, which is the ID of the destination if set or the type name
+func (d DestinationType) Label() string {
+	if d.ID != "" {
+		return d.ID
+	}
+	return d.Name
 }
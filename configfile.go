@@ -0,0 +1,248 @@
+package pukcab
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigFileError describes a problem reading a config file
+type ConfigFileError struct {
+	// The path of the config file
+	File string
+	// The line of the config file where the problem was found, or 0 if not known
+	Line int
+	// A description of the problem
+	Message string
+}
+
+func (e ConfigFileError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Message)
+	}
+	return fmt.Sprintf("%s: %s", e.File, e.Message)
+}
+
+// includeFile describes a config file that was included by another config file
+type includeFile struct {
+	Modules []ModuleType `json:"modules"`
+	Include []string     `json:"include"`
+}
+
+// LoadConfig will read the config file at the given path. The format of the file is determined by its extension, which
+// must be one of .json, .yaml, .yml, or .toml. Modules from any files listed in the include property are appended to
+// the modules of the config. Module defaults and variables are then applied to the config of each module. Returns a
+// ConfigFileError if the file could not be decoded.
+func LoadConfig(configFilePath string) (*Config, error) {
+	config := Config{}
+	if err := decodeConfigFile(configFilePath, &config); err != nil {
+		return nil, err
+	}
+
+	seen := map[string]bool{}
+	if absPath, err := filepath.Abs(configFilePath); err == nil {
+		seen[absPath] = true
+	}
+	modules, err := loadIncludes(configFilePath, config.Include, seen)
+	if err != nil {
+		return nil, err
+	}
+	config.Modules = append(config.Modules, modules...)
+
+	config.expandModules()
+
+	return &config, nil
+}
+
+// loadIncludes returns the modules from all of the config files matching the include patterns, which are relative to
+// the directory of the including file
+func loadIncludes(parentPath string, patterns []string, seen map[string]bool) ([]ModuleType, error) {
+	modules := []ModuleType{}
+	for _, pattern := range patterns {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(parentPath), pattern)
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, ConfigFileError{File: parentPath, Message: fmt.Sprintf("invalid include pattern '%s': %s", pattern, err.Error())}
+		}
+		if len(matches) == 0 && !strings.ContainsAny(pattern, "*?[") {
+			return nil, ConfigFileError{File: parentPath, Message: fmt.Sprintf("included file '%s' does not exist", pattern)}
+		}
+
+		for _, match := range matches {
+			absPath, err := filepath.Abs(match)
+			if err != nil {
+				return nil, err
+			}
+			if seen[absPath] {
+				return nil, ConfigFileError{File: parentPath, Message: fmt.Sprintf("file '%s' is included more than once", match)}
+			}
+			seen[absPath] = true
+
+			include := includeFile{}
+			if err := decodeConfigFile(match, &include); err != nil {
+				var fileErr ConfigFileError
+				if errors.As(err, &fileErr) && strings.HasPrefix(fileErr.Message, "unknown field") {
+					fileErr.Message += ", included files may only contain modules and include"
+					return nil, fileErr
+				}
+				return nil, err
+			}
+			log.PDebug("Included config file", map[string]interface{}{
+				"file_path": match,
+				"n_modules": len(include.Modules),
+			})
+			modules = append(modules, include.Modules...)
+
+			nested, err := loadIncludes(match, include.Include, seen)
+			if err != nil {
+				return nil, err
+			}
+			modules = append(modules, nested...)
+		}
+	}
+	return modules, nil
+}
+
+// decodeConfigFile will decode the config file at the given path into out, rejecting any unknown keys
+func decodeConfigFile(filePath string, out interface{}) error {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		var pathErr *os.PathError
+		if errors.As(err, &pathErr) {
+			return ConfigFileError{File: filePath, Message: pathErr.Err.Error()}
+		}
+		return err
+	}
+
+	switch strings.ToLower(filepath.Ext(filePath)) {
+	case ".json":
+		return decodeJSONConfig(filePath, data, out)
+	case ".yaml", ".yml":
+		return decodeYAMLConfig(filePath, data, out)
+	case ".toml":
+		return decodeTOMLConfig(filePath, data, out)
+	}
+	return ConfigFileError{File: filePath, Message: "unknown config file format, must be one of .json, .yaml, .yml, or .toml"}
+}
+
+func decodeJSONConfig(filePath string, data []byte, out interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(out)
+	if err == nil {
+		return nil
+	}
+
+	var syntaxErr *json.SyntaxError
+	if errors.As(err, &syntaxErr) {
+		return ConfigFileError{File: filePath, Line: lineForOffset(data, syntaxErr.Offset), Message: syntaxErr.Error()}
+	}
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		return ConfigFileError{File: filePath, Line: lineForOffset(data, typeErr.Offset), Message: typeErr.Error()}
+	}
+	return ConfigFileError{File: filePath, Line: lineForKey(data, unknownFieldName(err)), Message: strings.TrimPrefix(err.Error(), "json: ")}
+}
+
+func decodeYAMLConfig(filePath string, data []byte, out interface{}) error {
+	var generic interface{}
+	if err := yaml.Unmarshal(data, &generic); err != nil {
+		return ConfigFileError{File: filePath, Line: lineFromMessage(err.Error()), Message: err.Error()}
+	}
+	if err := decodeGenericConfig(generic, out); err != nil {
+		return ConfigFileError{File: filePath, Line: lineForKey(data, decodeErrorKey(err)), Message: strings.TrimPrefix(err.Error(), "json: ")}
+	}
+	return nil
+}
+
+func decodeTOMLConfig(filePath string, data []byte, out interface{}) error {
+	generic := map[string]interface{}{}
+	if err := toml.Unmarshal(data, &generic); err != nil {
+		var parseErr toml.ParseError
+		if errors.As(err, &parseErr) {
+			return ConfigFileError{File: filePath, Line: parseErr.Position.Line, Message: strings.TrimPrefix(parseErr.Error(), "toml: ")}
+		}
+		return ConfigFileError{File: filePath, Message: err.Error()}
+	}
+	if err := decodeGenericConfig(generic, out); err != nil {
+		return ConfigFileError{File: filePath, Line: lineForKey(data, decodeErrorKey(err)), Message: strings.TrimPrefix(err.Error(), "json: ")}
+	}
+	return nil
+}
+
+// decodeGenericConfig will decode a generic config, such as one read from a YAML or TOML file, into out
+func decodeGenericConfig(generic interface{}, out interface{}) error {
+	data, err := json.Marshal(generic)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(out)
+}
+
+var unknownFieldPattern = regexp.MustCompile(`unknown field "([^"]+)"`)
+
+// unknownFieldName returns the name of the field from an unknown field error, or an empty string
+func unknownFieldName(err error) string {
+	match := unknownFieldPattern.FindStringSubmatch(err.Error())
+	if match == nil {
+		return ""
+	}
+	return match[1]
+}
+
+// decodeErrorKey returns the name of the key that an error from decodeGenericConfig is about, or an empty string
+func decodeErrorKey(err error) string {
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) && typeErr.Field != "" {
+		fields := strings.Split(typeErr.Field, ".")
+		return fields[len(fields)-1]
+	}
+	return unknownFieldName(err)
+}
+
+var lineNumberPattern = regexp.MustCompile(`line ([0-9]+)`)
+
+// lineFromMessage returns the first line number mentioned in an error message, or 0
+func lineFromMessage(message string) int {
+	match := lineNumberPattern.FindStringSubmatch(message)
+	if match == nil {
+		return 0
+	}
+	line, _ := strconv.Atoi(match[1])
+	return line
+}
+
+// lineForOffset returns the line number of the given byte offset in data
+func lineForOffset(data []byte, offset int64) int {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	return bytes.Count(data[:offset], []byte("\n")) + 1
+}
+
+// lineForKey returns the line number of the first line in data that appears to define the given key, or 0
+func lineForKey(data []byte, key string) int {
+	if key == "" {
+		return 0
+	}
+	keyPattern := regexp.MustCompile(`^\s*(- )?["']?` + regexp.QuoteMeta(key) + `["']?\s*[:=]`)
+	for i, line := range strings.Split(string(data), "\n") {
+		if keyPattern.MatchString(line) {
+			return i + 1
+		}
+	}
+	return 0
+}
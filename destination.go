@@ -0,0 +1,375 @@
+package pukcab
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Destination describes a location that artifacts are copied to after each module runs, such as another disk or a
+// remote server. Keys are slash separated paths relative to the root of the destination, and mirror the layout of the
+// output directory, for example "http/2021-06-01/example.html".
+type Destination interface {
+	// Put will save the data from r, which is size bytes long, at the given key, replacing any existing data
+	Put(ctx context.Context, key string, r io.Reader, size int64) error
+	// Get will write the data saved at the given key to w
+	Get(ctx context.Context, key string, w io.Writer) error
+	// List returns every key that starts with the given prefix, including keys in any nested directories
+	List(ctx context.Context, prefix string) ([]string, error)
+	// Delete will remove the data saved at the given key
+	Delete(ctx context.Context, key string) error
+}
+
+// DestinationProvider describes a type of destination. Providers can also implement the Validator interface to check
+// their config before anything is run.
+type DestinationProvider interface {
+	Name() string
+	// Open returns a destination for the given config. Any secret references in the config have already been resolved.
+	Open(ctx context.Context, c interface{}) (Destination, error)
+}
+
+// TempPattern returns the os.CreateTemp pattern for a temporary file in the same directory as the file with the given
+// name. Files are written to a temporary file first and then renamed into place, so that a partial write never
+// replaces an existing file. Temporary files are hidden and end with .tmp, so they are skipped when listing artifacts.
+func TempPattern(name string) string {
+	return "." + path.Base(name) + ".*.tmp"
+}
+
+// TempPath returns a unique temporary path, named as described by TempPattern, in the same directory as the given
+// slash separated path. Use this instead of os.CreateTemp for files that aren't on the local disk.
+func TempPath(filePath string) (string, error) {
+	suffix := make([]byte, 6)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", err
+	}
+	return path.Join(path.Dir(filePath), "."+path.Base(filePath)+"."+hex.EncodeToString(suffix)+".tmp"), nil
+}
+
+// ContextReader returns a reader that stops reading from r once the context is cancelled, so that copying a large
+// artifact doesn't hold up a cancelled run
+func ContextReader(ctx context.Context, r io.Reader) io.Reader {
+	return &contextReader{ctx: ctx, r: r}
+}
+
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// OpenDestination describes a destination that is ready to use
+type OpenDestination struct {
+	// The label of the destination
+	Label string
+	// The retention policy of the destination, if set
+	Retention *RetentionPolicy
+	Destination
+}
+
+// DestinationResult describes what happened at a destination after a module ran
+type DestinationResult struct {
+	// The label of the destination
+	Destination string
+	// The keys that were saved to the destination
+	Uploaded []string
+	// The keys of the run directories that were removed, or would have been removed for dry runs, by the retention
+	// policy
+	Expired []string
+	// The error from the destination, if any
+	Error error
+}
+
+// OpenDestinations will open each of the destinations in the config. Providers are looked up by name in the given map.
+func OpenDestinations(ctx context.Context, config Config, providers map[string]DestinationProvider) ([]OpenDestination, error) {
+	destinations := []OpenDestination{}
+	for _, destinationType := range config.Destinations {
+		label := destinationType.Label()
+		provider, ok := providers[destinationType.Name]
+		if !ok {
+			return nil, fmt.Errorf("destination %s: '%s' is not a known destination", label, destinationType.Name)
+		}
+		destinationConfig, err := ResolveSecrets(ctx, destinationType.Config)
+		if err != nil {
+			return nil, fmt.Errorf("destination %s: %w", label, err)
+		}
+		destination, err := provider.Open(ctx, destinationConfig)
+		if err != nil {
+			log.PError("Error opening destination", map[string]interface{}{
+				"destination": label,
+				"error":       RedactSecrets(err.Error()),
+			})
+			return nil, fmt.Errorf("destination %s: %w", label, redactError(err))
+		}
+		destinations = append(destinations, OpenDestination{
+			Label:       label,
+			Retention:   destinationType.Retention,
+			Destination: destination,
+		})
+	}
+	return destinations, nil
+}
+
+// UploadRun will copy the artifacts and manifest from a module run to the destination
+func UploadRun(ctx context.Context, destination OpenDestination, result *RunResult) DestinationResult {
+	destinationResult := DestinationResult{Destination: destination.Label}
+
+	// Artifacts may have already been uploaded by an upload processor
+	uploaded := map[string]bool{}
+	for _, key := range result.uploaded[destination.Label] {
+		uploaded[key] = true
+		destinationResult.Uploaded = append(destinationResult.Uploaded, key)
+	}
+	// The run is incomplete at a destination that an upload processor failed to copy an artifact to
+	if err := result.uploadErrors[destination.Label]; err != nil {
+		destinationResult.Error = err
+		return destinationResult
+	}
+
+	filePaths := []string{}
+	for _, artifact := range result.Artifacts {
+		filePaths = append(filePaths, artifact.Path)
+	}
+	manifestPath := path.Join(result.Dir, ManifestFileName)
+	if _, err := os.Stat(manifestPath); err == nil {
+		// The manifest is uploaded last so that it never lists an artifact that isn't at the destination
+		filePaths = append(filePaths, manifestPath)
+	}
+
+	for _, filePath := range filePaths {
+		key, err := destinationKey(filePath)
+		if err != nil {
+			destinationResult.Error = err
+			return destinationResult
+		}
+		if uploaded[key] {
+			continue
+		}
+		if err := putFile(ctx, destination, key, filePath); err != nil {
+			log.PError("Error uploading artifact", map[string]interface{}{
+				"destination": destination.Label,
+				"instance":    result.Instance,
+				"key":         key,
+				"error":       err.Error(),
+			})
+			destinationResult.Error = fmt.Errorf("destination %s: %s: %w", destination.Label, key, err)
+			return destinationResult
+		}
+		log.PInfo("Uploaded artifact", map[string]interface{}{
+			"destination": destination.Label,
+			"instance":    result.Instance,
+			"key":         key,
+		})
+		destinationResult.Uploaded = append(destinationResult.Uploaded, key)
+	}
+	return destinationResult
+}
+
+func putFile(ctx context.Context, destination Destination, key string, filePath string) error {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return destination.Put(ctx, key, f, info.Size())
+}
+
+// CleanupDestination will remove expired runs of the module instance from the destination. The retention policy of
+// the destination is used if set, otherwise the retention policy of the module instance. Returns the keys of the run
+// directories that were removed, or that would have been removed if this is a dry run.
+func CleanupDestination(ctx context.Context, destination OpenDestination, module ContextModule, instance ModuleType) ([]string, error) {
+	return cleanupDestination(ctx, destination, module, instance, false)
+}
+
+// cleanupDestination removes expired runs from the destination. If planRun is true then the current run is treated as
+// having been uploaded, so that a dry run reports the same deletions as a real run would.
+func cleanupDestination(ctx context.Context, destination OpenDestination, module ContextModule, instance ModuleType, planRun bool) ([]string, error) {
+	policy := retentionPolicy(instance)
+	if destination.Retention != nil {
+		policy = *destination.Retention
+	}
+	if policy.IsEmpty() {
+		return nil, nil
+	}
+
+	prefix, err := instanceKeyPrefix(module, instance)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := destination.List(ctx, prefix)
+	if err != nil {
+		log.PError("Error listing destination", map[string]interface{}{
+			"destination": destination.Label,
+			"prefix":      prefix,
+			"error":       err.Error(),
+		})
+		return nil, err
+	}
+
+	runKeys := map[string][]string{}
+	for _, key := range keys {
+		runDir, _, ok := splitKey(strings.TrimPrefix(key, prefix))
+		if !ok {
+			continue
+		}
+		runKeys[runDir] = append(runKeys[runDir], key)
+	}
+	if _, ok := runKeys[runDirName()]; planRun && !ok {
+		runKeys[runDirName()] = nil
+	}
+	runDirs := make([]string, 0, len(runKeys))
+	for runDir := range runKeys {
+		runDirs = append(runDirs, runDir)
+	}
+	sort.Strings(runDirs)
+
+	hasArtifacts := func(runDir string) bool {
+		if planRun && runDir == runDirName() {
+			return true
+		}
+		for _, key := range runKeys[runDir] {
+			if path.Base(key) != ManifestFileName {
+				return true
+			}
+		}
+		return false
+	}
+	expired := policy.Expired(runDirs, hasArtifacts)
+	// When unchanged artifacts are discarded the only copy of an artifact may be in an old run directory
+	if changes := changeDetectionConfig(instance); changes != nil && changes.Unchanged == UnchangedDiscard && len(expired) > 0 {
+		runs, err := DestinationRuns(ctx, destination, module, instance)
+		if err != nil {
+			return nil, err
+		}
+		kept := map[string]bool{}
+		for _, prev := range latestArtifacts(runs) {
+			kept[strings.TrimPrefix(prev.Dir, prefix)] = true
+		}
+		unkept := []string{}
+		for _, runDir := range expired {
+			if kept[runDir] {
+				log.PInfo("Keeping expired run directory with the latest copy of an artifact", map[string]interface{}{
+					"destination": destination.Label,
+					"instance":    instance.Label(),
+					"key":         prefix + runDir,
+				})
+				continue
+			}
+			unkept = append(unkept, runDir)
+		}
+		expired = unkept
+	}
+
+	dryRun := IsDryRun()
+	removed := []string{}
+	for _, runDir := range expired {
+		removed = append(removed, prefix+runDir)
+		if dryRun {
+			log.Warn("Artifact would expire: destination='%s' key='%s'", destination.Label, prefix+runDir)
+			continue
+		}
+		log.Warn("Artifact expired: destination='%s' key='%s'", destination.Label, prefix+runDir)
+		for _, key := range runKeys[runDir] {
+			if err := destination.Delete(ctx, key); err != nil {
+				log.Error("Error removing expired artifact: destination='%s' key='%s' error='%s'", destination.Label, key, err.Error())
+				return removed, err
+			}
+		}
+	}
+	return removed, nil
+}
+
+// DestinationRuns returns every run of the given module instance that was recorded in a manifest at the destination,
+// sorted oldest first. The Dir of each run is the key of its run directory.
+func DestinationRuns(ctx context.Context, destination OpenDestination, module ContextModule, instance ModuleType) ([]SavedRun, error) {
+	prefix, err := instanceKeyPrefix(module, instance)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := destination.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	label := instance.Label()
+	runs := []SavedRun{}
+	for _, key := range keys {
+		runDir, name, ok := splitKey(strings.TrimPrefix(key, prefix))
+		if !ok || name != ManifestFileName {
+			continue
+		}
+		buf := &bytes.Buffer{}
+		if err := destination.Get(ctx, key, buf); err != nil {
+			return nil, err
+		}
+		manifest := Manifest{}
+		if err := json.Unmarshal(buf.Bytes(), &manifest); err != nil {
+			log.PWarn("Error reading manifest", map[string]interface{}{
+				"destination": destination.Label,
+				"key":         key,
+				"error":       err.Error(),
+			})
+			continue
+		}
+		for _, run := range manifest.Runs {
+			if run.Module != module.Name() || run.Instance != label {
+				continue
+			}
+			runs = append(runs, SavedRun{Dir: prefix + runDir, ManifestRun: run})
+		}
+	}
+
+	sort.SliceStable(runs, func(i, j int) bool {
+		return runs[i].Start.Before(runs[j].Start)
+	})
+	return runs, nil
+}
+
+// destinationKey returns the key for a file in the output directory
+func destinationKey(filePath string) (string, error) {
+	rel, err := filepath.Rel(pukcabConfig.OutputDir, filePath)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return "", fmt.Errorf("%s is not in the output directory", filePath)
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+// instanceKeyPrefix returns the prefix of all keys for runs of the module instance, including a trailing slash
+func instanceKeyPrefix(module ContextModule, instance ModuleType) (string, error) {
+	outputDir, err := instanceOutputDir(module, instance)
+	if err != nil {
+		return "", err
+	}
+	key, err := destinationKey(outputDir)
+	if err != nil {
+		return "", err
+	}
+	return key + "/", nil
+}
+
+// splitKey splits a key relative to an instance prefix into the run directory and the rest of the key
+func splitKey(key string) (string, string, bool) {
+	parts := strings.SplitN(key, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
@@ -0,0 +1,166 @@
+package local
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/ecnepsnai/pukcab"
+)
+
+const Name = "local"
+
+type LocalConfig struct {
+	Path string `json:"path"`
+}
+
+// LocalProvider the local directory pukcab destination
+type LocalProvider struct{}
+
+func (p LocalProvider) Name() string {
+	return Name
+}
+
+func (p LocalProvider) Open(ctx context.Context, c interface{}) (pukcab.Destination, error) {
+	config := LocalConfig{}
+	if err := pukcab.MarshallConfig(c, &config); err != nil {
+		return nil, fmt.Errorf("invalid config for destination: %w", err)
+	}
+
+	// The directory is created by the first upload
+	return &localDestination{root: config.Path}, nil
+}
+
+// Validate checks the destination config for problems
+func (p LocalProvider) Validate(c interface{}) error {
+	config := LocalConfig{}
+	if err := pukcab.MarshallConfig(c, &config); err != nil {
+		return fmt.Errorf("%s: %w", Name, err)
+	}
+
+	errs := pukcab.ConfigErrors{}
+	if config.Path == "" {
+		errs = append(errs, pukcab.RequiredField(Name, "path"))
+	} else if !filepath.IsAbs(config.Path) {
+		errs = append(errs, pukcab.FieldError{Module: Name, Field: "path", Message: "must be an absolute path"})
+	}
+	return errs.Err()
+}
+
+type localDestination struct {
+	root string
+}
+
+// filePath returns the path of the file for the given key, which must not be outside of the root directory
+func (d *localDestination) filePath(key string) (string, error) {
+	cleaned := path.Clean("/" + key)
+	if cleaned == "/" {
+		return "", fmt.Errorf("invalid key '%s'", key)
+	}
+	return filepath.Join(d.root, filepath.FromSlash(cleaned)), nil
+}
+
+func (d *localDestination) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	filePath, err := d.filePath(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(filePath), os.ModePerm); err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so that a partial upload never replaces an existing file
+	f, err := os.CreateTemp(filepath.Dir(filePath), pukcab.TempPattern(filepath.Base(filePath)))
+	if err != nil {
+		return err
+	}
+	tmpPath := f.Name()
+	n, err := io.Copy(f, pukcab.ContextReader(ctx, r))
+	if err == nil && n != size {
+		err = fmt.Errorf("wrote %d bytes, expected %d", n, size)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmpPath, 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, filePath)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
+
+func (d *localDestination) Get(ctx context.Context, key string, w io.Writer) error {
+	filePath, err := d.filePath(key)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, pukcab.ContextReader(ctx, f))
+	return err
+}
+
+func (d *localDestination) List(ctx context.Context, prefix string) ([]string, error) {
+	keys := []string{}
+	err := filepath.WalkDir(d.root, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if entry.IsDir() || strings.HasSuffix(entry.Name(), ".tmp") {
+			return nil
+		}
+		rel, err := filepath.Rel(d.root, filePath)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func (d *localDestination) Delete(ctx context.Context, key string) error {
+	filePath, err := d.filePath(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	// Remove any directories left empty, but never the root directory
+	dir := filepath.Dir(filePath)
+	for dir != filepath.Clean(d.root) && strings.HasPrefix(dir, filepath.Clean(d.root)) {
+		if err := os.Remove(dir); err != nil {
+			break
+		}
+		dir = filepath.Dir(dir)
+	}
+	return nil
+}
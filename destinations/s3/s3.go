@@ -0,0 +1,362 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ecnepsnai/pukcab"
+)
+
+const Name = "s3"
+
+// The smallest part size allowed by S3, except for the last part of an upload
+const minPartSizeMB = 5
+
+type S3Config struct {
+	Endpoint                   string `json:"endpoint"`
+	Region                     string `json:"region"`
+	Bucket                     string `json:"bucket"`
+	AccessKeyID                string `json:"access_key_id"`
+	SecretAccessKey            string `json:"secret_access_key"`
+	SessionToken               string `json:"session_token"`
+	Prefix                     string `json:"prefix"`
+	PathStyle                  bool   `json:"path_style"`
+	ServerSideEncryption       string `json:"server_side_encryption"`
+	KMSKeyID                   string `json:"kms_key_id"`
+	StorageClass               string `json:"storage_class"`
+	PartSizeMB                 int    `json:"part_size_mb"`
+	AllowUntrustedCertificates bool   `json:"allow_untrusted_certificates"`
+}
+
+// S3Provider the S3-compatible object storage pukcab destination
+type S3Provider struct{}
+
+func (p S3Provider) Name() string {
+	return Name
+}
+
+func (p S3Provider) Open(ctx context.Context, c interface{}) (pukcab.Destination, error) {
+	config := S3Config{
+		PartSizeMB: 16,
+	}
+	if err := pukcab.MarshallConfig(c, &config); err != nil {
+		return nil, fmt.Errorf("invalid config for destination: %w", err)
+	}
+
+	if config.PartSizeMB < minPartSizeMB {
+		config.PartSizeMB = 16
+	}
+	endpoint := config.Endpoint
+	if endpoint == "" {
+		endpoint = "https://s3." + config.Region + ".amazonaws.com"
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	tr := &http.Transport{}
+	if config.AllowUntrustedCertificates {
+		tr.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+
+	prefix := strings.TrimPrefix(config.Prefix, "/")
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	return &s3Destination{
+		config:   config,
+		endpoint: u,
+		prefix:   prefix,
+		client:   &http.Client{Transport: tr},
+	}, nil
+}
+
+// Validate checks the destination config for problems
+func (p S3Provider) Validate(c interface{}) error {
+	config := S3Config{}
+	if err := pukcab.MarshallConfig(c, &config); err != nil {
+		return fmt.Errorf("%s: %w", Name, err)
+	}
+
+	errs := pukcab.ConfigErrors{}
+	if config.Region == "" {
+		errs = append(errs, pukcab.RequiredField(Name, "region"))
+	}
+	if config.Bucket == "" {
+		errs = append(errs, pukcab.RequiredField(Name, "bucket"))
+	}
+	if config.AccessKeyID == "" {
+		errs = append(errs, pukcab.RequiredField(Name, "access_key_id"))
+	}
+	if config.SecretAccessKey == "" {
+		errs = append(errs, pukcab.RequiredField(Name, "secret_access_key"))
+	}
+	if config.Endpoint != "" && !pukcab.IsSecretReference(config.Endpoint) {
+		if u, err := url.Parse(config.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, pukcab.FieldError{Module: Name, Field: "endpoint", Message: "must be a http or https URL"})
+		}
+	}
+	switch {
+	case config.ServerSideEncryption == "", config.ServerSideEncryption == "AES256", config.ServerSideEncryption == "aws:kms":
+	case pukcab.IsSecretReference(config.ServerSideEncryption):
+	default:
+		errs = append(errs, pukcab.FieldError{Module: Name, Field: "server_side_encryption", Message: "must be AES256 or aws:kms"})
+	}
+	if config.KMSKeyID != "" && config.ServerSideEncryption != "aws:kms" && !pukcab.IsSecretReference(config.ServerSideEncryption) {
+		errs = append(errs, pukcab.FieldError{Module: Name, Field: "kms_key_id", Message: "requires server_side_encryption to be aws:kms"})
+	}
+	if config.PartSizeMB != 0 && config.PartSizeMB < minPartSizeMB {
+		errs = append(errs, pukcab.FieldError{Module: Name, Field: "part_size_mb", Message: fmt.Sprintf("must be at least %d", minPartSizeMB)})
+	}
+	return errs.Err()
+}
+
+type s3Destination struct {
+	config   S3Config
+	endpoint *url.URL
+	prefix   string
+	client   *http.Client
+}
+
+// objectURL returns the URL for the object with the given key, or the bucket if key is empty
+func (d *s3Destination) objectURL(key string, query url.Values) *url.URL {
+	u := *d.endpoint
+	objectPath := "/" + key
+	if d.config.PathStyle {
+		objectPath = "/" + d.config.Bucket + objectPath
+	} else {
+		u.Host = d.config.Bucket + "." + u.Host
+	}
+	u.Path = objectPath
+	u.RawPath = uriEncode(objectPath, false)
+	if query != nil {
+		u.RawQuery = canonicalQuery(query)
+	}
+	return &u
+}
+
+// do makes a signed request to S3. Returns an error if the response status is not 2xx.
+func (d *s3Destination) do(ctx context.Context, method string, u *url.URL, headers map[string]string, body []byte) (*http.Response, error) {
+	request, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	request.ContentLength = int64(len(body))
+	for k, v := range headers {
+		request.Header.Set(k, v)
+	}
+	payloadHash := emptyPayloadHash
+	if len(body) > 0 {
+		payloadHash = sha256Hex(body)
+	}
+	signRequest(request, d.config, payloadHash, time.Now())
+
+	response, err := d.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		defer response.Body.Close()
+		return nil, responseError(response)
+	}
+	return response, nil
+}
+
+// responseError returns an error describing an S3 error response
+func responseError(response *http.Response) error {
+	type s3Error struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	e := s3Error{}
+	data, _ := io.ReadAll(io.LimitReader(response.Body, 64*1024))
+	if err := xml.Unmarshal(data, &e); err != nil || e.Code == "" {
+		return fmt.Errorf("http %d", response.StatusCode)
+	}
+	return fmt.Errorf("%s: %s (http %d)", e.Code, e.Message, response.StatusCode)
+}
+
+// uploadHeaders returns the headers for creating an object
+func (d *s3Destination) uploadHeaders() map[string]string {
+	headers := map[string]string{}
+	if d.config.ServerSideEncryption != "" {
+		headers["X-Amz-Server-Side-Encryption"] = d.config.ServerSideEncryption
+	}
+	if d.config.KMSKeyID != "" {
+		headers["X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id"] = d.config.KMSKeyID
+	}
+	if d.config.StorageClass != "" {
+		headers["X-Amz-Storage-Class"] = d.config.StorageClass
+	}
+	return headers
+}
+
+func (d *s3Destination) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	partSize := int64(d.config.PartSizeMB) * 1024 * 1024
+	if size > partSize {
+		return d.multipartUpload(ctx, key, r, partSize)
+	}
+
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	response, err := d.do(ctx, "PUT", d.objectURL(d.prefix+key, nil), d.uploadHeaders(), body)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	return nil
+}
+
+// multipartUpload uploads the data from r in parts of partSize bytes, so that large artifacts don't need to be held in
+// memory
+func (d *s3Destination) multipartUpload(ctx context.Context, key string, r io.Reader, partSize int64) error {
+	objectKey := d.prefix + key
+	response, err := d.do(ctx, "POST", d.objectURL(objectKey, url.Values{"uploads": {""}}), d.uploadHeaders(), nil)
+	if err != nil {
+		return err
+	}
+	type initiateResult struct {
+		UploadID string `xml:"UploadId"`
+	}
+	initiated := initiateResult{}
+	err = xml.NewDecoder(response.Body).Decode(&initiated)
+	response.Body.Close()
+	if err != nil {
+		return fmt.Errorf("error starting multipart upload: %w", err)
+	}
+
+	type completedPart struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	}
+	parts := []completedPart{}
+	uploadErr := func() error {
+		buf := make([]byte, partSize)
+		for partNumber := 1; ; partNumber++ {
+			n, err := io.ReadFull(r, buf)
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil && err != io.ErrUnexpectedEOF {
+				return err
+			}
+			query := url.Values{
+				"partNumber": {strconv.Itoa(partNumber)},
+				"uploadId":   {initiated.UploadID},
+			}
+			response, err := d.do(ctx, "PUT", d.objectURL(objectKey, query), nil, buf[:n])
+			if err != nil {
+				return fmt.Errorf("part %d: %w", partNumber, err)
+			}
+			response.Body.Close()
+			parts = append(parts, completedPart{PartNumber: partNumber, ETag: response.Header.Get("ETag")})
+			if n < len(buf) {
+				return nil
+			}
+		}
+	}()
+	if uploadErr == nil {
+		type completeUpload struct {
+			XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+			Parts   []completedPart `xml:"Part"`
+		}
+		body, err := xml.Marshal(completeUpload{Parts: parts})
+		if err != nil {
+			return err
+		}
+		response, err := d.do(ctx, "POST", d.objectURL(objectKey, url.Values{"uploadId": {initiated.UploadID}}), nil, body)
+		if err == nil {
+			// S3 can report an error after starting a successful response to a complete request
+			data, readErr := io.ReadAll(response.Body)
+			response.Body.Close()
+			if readErr != nil {
+				err = readErr
+			} else if bytes.Contains(data, []byte("<Error>")) {
+				err = fmt.Errorf("error completing multipart upload: %s", data)
+			}
+		}
+		if err == nil {
+			return nil
+		}
+		uploadErr = err
+	}
+
+	// Abort the upload so that the uploaded parts aren't kept, and charged for, forever
+	abortCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if response, err := d.do(abortCtx, "DELETE", d.objectURL(objectKey, url.Values{"uploadId": {initiated.UploadID}}), nil, nil); err == nil {
+		response.Body.Close()
+	}
+	return uploadErr
+}
+
+func (d *s3Destination) Get(ctx context.Context, key string, w io.Writer) error {
+	response, err := d.do(ctx, "GET", d.objectURL(d.prefix+key, nil), nil, nil)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	_, err = io.Copy(w, response.Body)
+	return err
+}
+
+func (d *s3Destination) List(ctx context.Context, prefix string) ([]string, error) {
+	type listResult struct {
+		Contents []struct {
+			Key string `xml:"Key"`
+		} `xml:"Contents"`
+		IsTruncated           bool   `xml:"IsTruncated"`
+		NextContinuationToken string `xml:"NextContinuationToken"`
+	}
+
+	keys := []string{}
+	continuationToken := ""
+	for {
+		query := url.Values{
+			"list-type": {"2"},
+			"prefix":    {d.prefix + prefix},
+		}
+		if continuationToken != "" {
+			query.Set("continuation-token", continuationToken)
+		}
+		response, err := d.do(ctx, "GET", d.objectURL("", query), nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		result := listResult{}
+		err = xml.NewDecoder(response.Body).Decode(&result)
+		response.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, object := range result.Contents {
+			keys = append(keys, strings.TrimPrefix(object.Key, d.prefix))
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return keys, nil
+		}
+		continuationToken = result.NextContinuationToken
+	}
+}
+
+func (d *s3Destination) Delete(ctx context.Context, key string) error {
+	response, err := d.do(ctx, "DELETE", d.objectURL(d.prefix+key, nil), nil, nil)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	return nil
+}
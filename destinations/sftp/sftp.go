@@ -0,0 +1,340 @@
+package sftp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ecnepsnai/pukcab"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+const Name = "sftp"
+
+type SFTPConfig struct {
+	HostAddress   string `json:"host_address"`
+	Port          uint16 `json:"port"`
+	Username      string `json:"username"`
+	PrivateKey    string `json:"private_key"`
+	HostPublicKey string `json:"host_public_key"`
+	Path          string `json:"path"`
+}
+
+// SFTPProvider the SFTP pukcab destination
+type SFTPProvider struct{}
+
+func (p SFTPProvider) Name() string {
+	return Name
+}
+
+func (p SFTPProvider) Open(ctx context.Context, c interface{}) (pukcab.Destination, error) {
+	config := SFTPConfig{}
+	if err := pukcab.MarshallConfig(c, &config); err != nil {
+		return nil, fmt.Errorf("invalid config for destination: %w", err)
+	}
+
+	signer, err := ssh.ParsePrivateKey([]byte(config.PrivateKey))
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key: %w", err)
+	}
+	hostKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(config.HostPublicKey))
+	if err != nil {
+		return nil, fmt.Errorf("invalid host public key: %w", err)
+	}
+
+	port := config.Port
+	if port == 0 {
+		port = 22
+	}
+
+	// The connection is made by the first operation, so that destinations that are never used aren't connected to
+	return &sftpDestination{
+		config:  config,
+		address: net.JoinHostPort(config.HostAddress, strconv.Itoa(int(port))),
+		clientConfig: &ssh.ClientConfig{
+			User:              config.Username,
+			Auth:              []ssh.AuthMethod{ssh.PublicKeys(signer)},
+			HostKeyCallback:   ssh.FixedHostKey(hostKey),
+			HostKeyAlgorithms: []string{hostKey.Type()},
+			Timeout:           30 * time.Second,
+		},
+	}, nil
+}
+
+// Validate checks the destination config for problems
+func (p SFTPProvider) Validate(c interface{}) error {
+	config := SFTPConfig{}
+	if err := pukcab.MarshallConfig(c, &config); err != nil {
+		return fmt.Errorf("%s: %w", Name, err)
+	}
+
+	errs := pukcab.ConfigErrors{}
+	if config.HostAddress == "" {
+		errs = append(errs, pukcab.RequiredField(Name, "host_address"))
+	}
+	if config.Username == "" {
+		errs = append(errs, pukcab.RequiredField(Name, "username"))
+	}
+	if config.PrivateKey == "" {
+		errs = append(errs, pukcab.RequiredField(Name, "private_key"))
+	}
+	if config.HostPublicKey == "" {
+		errs = append(errs, pukcab.RequiredField(Name, "host_public_key"))
+	}
+	if config.Path == "" {
+		errs = append(errs, pukcab.RequiredField(Name, "path"))
+	}
+	return errs.Err()
+}
+
+type sftpDestination struct {
+	config       SFTPConfig
+	address      string
+	clientConfig *ssh.ClientConfig
+	lock         sync.Mutex
+	sshClient    *ssh.Client
+	client       *sftp.Client
+}
+
+// connect returns the SFTP client, connecting to the host if needed
+func (d *sftpDestination) connect(ctx context.Context) (*sftp.Client, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.client != nil {
+		return d.client, nil
+	}
+
+	dialer := &net.Dialer{Timeout: d.clientConfig.Timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", d.address)
+	if err != nil {
+		return nil, err
+	}
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, d.address, d.clientConfig)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	sshClient := ssh.NewClient(sshConn, chans, reqs)
+	client, err := sftp.NewClient(sshClient)
+	if err != nil {
+		sshClient.Close()
+		return nil, err
+	}
+	d.sshClient = sshClient
+	d.client = client
+	return client, nil
+}
+
+// disconnect closes the connection of the given client, if it is still the current client, so that the next operation
+// connects again
+func (d *sftpDestination) disconnect(client *sftp.Client) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.client != client {
+		return
+	}
+	d.client.Close()
+	d.sshClient.Close()
+	d.client = nil
+	d.sshClient = nil
+}
+
+// isConnectionError returns true if err means that the connection to the host was lost
+func isConnectionError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, sftp.ErrSSHFxConnectionLost) || errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr)
+}
+
+// withClient calls fn with the SFTP client. If the connection was lost, such as when the host closed an idle
+// connection, then the host is connected to again and fn is called once more.
+func (d *sftpDestination) withClient(ctx context.Context, fn func(client *sftp.Client) error) error {
+	client, err := d.connect(ctx)
+	if err != nil {
+		return err
+	}
+	err = fn(client)
+	if !isConnectionError(err) || ctx.Err() != nil {
+		return err
+	}
+	d.disconnect(client)
+	client, err = d.connect(ctx)
+	if err != nil {
+		return err
+	}
+	return fn(client)
+}
+
+// filePath returns the remote path of the file for the given key, which must not be outside of the root directory
+func (d *sftpDestination) filePath(key string) (string, error) {
+	cleaned := path.Clean("/" + key)
+	if cleaned == "/" {
+		return "", fmt.Errorf("invalid key '%s'", key)
+	}
+	return path.Join(d.config.Path, cleaned), nil
+}
+
+func (d *sftpDestination) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	filePath, err := d.filePath(key)
+	if err != nil {
+		return err
+	}
+
+	retried := false
+	return d.withClient(ctx, func(client *sftp.Client) error {
+		// The data has to be read again after connecting again
+		if retried {
+			seeker, ok := r.(io.Seeker)
+			if !ok {
+				return sftp.ErrSSHFxConnectionLost
+			}
+			if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+		}
+		retried = true
+
+		if err := client.MkdirAll(path.Dir(filePath)); err != nil {
+			return err
+		}
+
+		// Write to a temporary file first so that a partial upload never replaces an existing file
+		tmpPath, err := pukcab.TempPath(filePath)
+		if err != nil {
+			return err
+		}
+		f, err := client.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+		if err != nil {
+			return err
+		}
+		n, err := io.Copy(f, pukcab.ContextReader(ctx, r))
+		if err == nil && n != size {
+			err = fmt.Errorf("wrote %d bytes, expected %d", n, size)
+		}
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = client.Chmod(tmpPath, 0644)
+		}
+		if err == nil {
+			err = rename(client, tmpPath, filePath)
+		}
+		if err != nil {
+			client.Remove(tmpPath)
+			return err
+		}
+		return nil
+	})
+}
+
+// rename will move oldPath to newPath, replacing newPath if it exists. The posix-rename extension is used if the server
+// supports it, since a plain SFTP rename fails if newPath exists.
+func rename(client *sftp.Client, oldPath string, newPath string) error {
+	if _, ok := client.HasExtension("posix-rename@openssh.com"); ok {
+		return client.PosixRename(oldPath, newPath)
+	}
+	if err := client.Remove(newPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return client.Rename(oldPath, newPath)
+}
+
+func (d *sftpDestination) Get(ctx context.Context, key string, w io.Writer) error {
+	filePath, err := d.filePath(key)
+	if err != nil {
+		return err
+	}
+	return d.withClient(ctx, func(client *sftp.Client) error {
+		f, err := client.Open(filePath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		n, err := io.Copy(w, pukcab.ContextReader(ctx, f))
+		if err != nil && n > 0 {
+			// Part of the file was already written, so it can't be read again
+			return fmt.Errorf("error reading %s: %s", filePath, err.Error())
+		}
+		return err
+	})
+}
+
+func (d *sftpDestination) List(ctx context.Context, prefix string) ([]string, error) {
+	// Only walk the deepest directory that contains the prefix
+	walkRoot := d.config.Path
+	if i := strings.LastIndex(prefix, "/"); i > 0 {
+		walkRoot = path.Join(d.config.Path, path.Clean("/"+prefix[:i]))
+	}
+
+	var keys []string
+	err := d.withClient(ctx, func(client *sftp.Client) error {
+		keys = []string{}
+		if _, err := client.Stat(walkRoot); err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		root := path.Clean(d.config.Path) + "/"
+		walker := client.Walk(walkRoot)
+		for walker.Step() {
+			if err := walker.Err(); err != nil {
+				return err
+			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if walker.Stat().IsDir() || strings.HasSuffix(walker.Path(), ".tmp") {
+				continue
+			}
+			key := strings.TrimPrefix(walker.Path(), root)
+			if strings.HasPrefix(key, prefix) {
+				keys = append(keys, key)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func (d *sftpDestination) Delete(ctx context.Context, key string) error {
+	filePath, err := d.filePath(key)
+	if err != nil {
+		return err
+	}
+	return d.withClient(ctx, func(client *sftp.Client) error {
+		if err := client.Remove(filePath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		// Remove any directories left empty, but never the root directory
+		root := path.Clean(d.config.Path)
+		dir := path.Dir(filePath)
+		for dir != root && strings.HasPrefix(dir, root) {
+			if err := client.RemoveDirectory(dir); err != nil {
+				break
+			}
+			dir = path.Dir(dir)
+		}
+		return nil
+	})
+}
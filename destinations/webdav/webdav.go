@@ -0,0 +1,454 @@
+package webdav
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ecnepsnai/pukcab"
+)
+
+const Name = "webdav"
+
+type WebDAVConfig struct {
+	URL                        string `json:"url"`
+	Username                   string `json:"username"`
+	Password                   string `json:"password"`
+	Auth                       string `json:"auth"`
+	AllowUntrustedCertificates bool   `json:"allow_untrusted_certificates"`
+}
+
+// WebDAVProvider the WebDAV pukcab destination
+type WebDAVProvider struct{}
+
+func (p WebDAVProvider) Name() string {
+	return Name
+}
+
+func (p WebDAVProvider) Open(ctx context.Context, c interface{}) (pukcab.Destination, error) {
+	config := WebDAVConfig{}
+	if err := pukcab.MarshallConfig(c, &config); err != nil {
+		return nil, fmt.Errorf("invalid config for destination: %w", err)
+	}
+	if config.Auth == "" && config.Username != "" {
+		config.Auth = "basic"
+	}
+
+	base, err := url.Parse(config.URL)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(base.Path, "/") {
+		base.Path += "/"
+	}
+	base.RawPath = ""
+
+	tr := &http.Transport{}
+	if config.AllowUntrustedCertificates {
+		tr.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+
+	return &webdavDestination{
+		config:      config,
+		base:        base,
+		client:      &http.Client{Transport: tr},
+		collections: map[string]bool{},
+	}, nil
+}
+
+// Validate checks the destination config for problems
+func (p WebDAVProvider) Validate(c interface{}) error {
+	config := WebDAVConfig{}
+	if err := pukcab.MarshallConfig(c, &config); err != nil {
+		return fmt.Errorf("%s: %w", Name, err)
+	}
+
+	errs := pukcab.ConfigErrors{}
+	if config.URL == "" {
+		errs = append(errs, pukcab.RequiredField(Name, "url"))
+	} else if !pukcab.IsSecretReference(config.URL) {
+		if u, err := url.Parse(config.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, pukcab.FieldError{Module: Name, Field: "url", Message: "must be a http or https URL"})
+		}
+	}
+	switch {
+	case config.Auth == "":
+	case config.Auth == "basic", config.Auth == "digest", pukcab.IsSecretReference(config.Auth):
+		if config.Username == "" {
+			errs = append(errs, pukcab.RequiredField(Name, "username"))
+		}
+	default:
+		errs = append(errs, pukcab.FieldError{Module: Name, Field: "auth", Message: "must be basic or digest"})
+	}
+	return errs.Err()
+}
+
+type webdavDestination struct {
+	config    WebDAVConfig
+	base      *url.URL
+	client    *http.Client
+	lock      sync.Mutex
+	challenge *digestChallenge
+	// The keys of collections that are known to exist
+	collections map[string]bool
+}
+
+// keyURL returns the URL for the given key, which must not be outside of the base URL
+func (d *webdavDestination) keyURL(key string) (string, error) {
+	cleaned := path.Clean("/" + key)
+	if cleaned == "/" {
+		return "", fmt.Errorf("invalid key '%s'", key)
+	}
+	u := *d.base
+	u.Path += cleaned[1:]
+	return u.String(), nil
+}
+
+// collectionURL returns the URL of the collection with the given key, or the base URL if key is empty
+func (d *webdavDestination) collectionURL(key string) string {
+	u := *d.base
+	if key != "" {
+		u.Path += key + "/"
+	}
+	return u.String()
+}
+
+// authorize adds the authorization header to the request
+func (d *webdavDestination) authorize(request *http.Request) error {
+	switch d.config.Auth {
+	case "basic":
+		request.SetBasicAuth(d.config.Username, d.config.Password)
+	case "digest":
+		d.lock.Lock()
+		defer d.lock.Unlock()
+		if d.challenge == nil {
+			return nil
+		}
+		authorization, err := d.challenge.authorization(d.config.Username, d.config.Password, request.Method, request.URL.RequestURI())
+		if err != nil {
+			return err
+		}
+		request.Header.Set("Authorization", authorization)
+	}
+	return nil
+}
+
+// updateChallenge saves the digest challenge from an unauthorized response. Returns false if there was no challenge.
+func (d *webdavDestination) updateChallenge(response *http.Response) bool {
+	if d.config.Auth != "digest" {
+		return false
+	}
+	for _, header := range response.Header.Values("WWW-Authenticate") {
+		if challenge, ok := parseDigestChallenge(header); ok {
+			d.lock.Lock()
+			d.challenge = challenge
+			d.lock.Unlock()
+			return true
+		}
+	}
+	return false
+}
+
+// do makes a request with the given body. If the server asks for digest authentication then the request is retried
+// once with the new challenge. The caller must check the status of the response.
+func (d *webdavDestination) do(ctx context.Context, method string, target string, headers map[string]string, body []byte) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		request, err := http.NewRequestWithContext(ctx, method, target, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range headers {
+			request.Header.Set(k, v)
+		}
+		if err := d.authorize(request); err != nil {
+			return nil, err
+		}
+		response, err := d.client.Do(request)
+		if err != nil {
+			return nil, err
+		}
+		if response.StatusCode == http.StatusUnauthorized && attempt == 0 && d.updateChallenge(response) {
+			response.Body.Close()
+			continue
+		}
+		return response, nil
+	}
+}
+
+// expectStatus closes the response and returns an error if its status is not one of the given statuses
+func expectStatus(response *http.Response, statuses ...int) error {
+	defer response.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(response.Body, 64*1024))
+	for _, status := range statuses {
+		if response.StatusCode == status {
+			return nil
+		}
+	}
+	return fmt.Errorf("http %d", response.StatusCode)
+}
+
+// makeCollections creates the collection with the given key and any missing parent collections
+func (d *webdavDestination) makeCollections(ctx context.Context, key string) error {
+	parts := strings.Split(key, "/")
+	for i := range parts {
+		collection := strings.Join(parts[:i+1], "/")
+		d.lock.Lock()
+		exists := d.collections[collection]
+		d.lock.Unlock()
+		if exists {
+			continue
+		}
+
+		response, err := d.do(ctx, "MKCOL", d.collectionURL(collection), nil, nil)
+		if err != nil {
+			return err
+		}
+		// 405 Method Not Allowed is returned if the collection already exists
+		if err := expectStatus(response, http.StatusCreated, http.StatusMethodNotAllowed); err != nil {
+			return fmt.Errorf("error creating collection %s: %w", collection, err)
+		}
+		d.lock.Lock()
+		d.collections[collection] = true
+		d.lock.Unlock()
+	}
+	return nil
+}
+
+func (d *webdavDestination) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	target, err := d.keyURL(key)
+	if err != nil {
+		return err
+	}
+	cleaned := path.Clean("/" + key)[1:]
+	collection := path.Dir(cleaned)
+	if collection == "." {
+		collection = ""
+	} else if err := d.makeCollections(ctx, collection); err != nil {
+		return err
+	}
+
+	// Upload to a temporary name first so that a partial upload never replaces an existing file
+	tmpKey, err := pukcab.TempPath(cleaned)
+	if err != nil {
+		return err
+	}
+	tmpTarget, err := d.keyURL(tmpKey)
+	if err != nil {
+		return err
+	}
+
+	err = d.upload(ctx, tmpTarget, collection, r, size)
+	if err == nil {
+		var response *http.Response
+		response, err = d.do(ctx, "MOVE", tmpTarget, map[string]string{"Destination": target, "Overwrite": "T"}, nil)
+		if err == nil {
+			err = expectStatus(response, http.StatusCreated, http.StatusNoContent)
+		}
+	}
+	if err != nil {
+		deleteCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if response, deleteErr := d.do(deleteCtx, "DELETE", tmpTarget, nil, nil); deleteErr == nil {
+			response.Body.Close()
+		}
+		return err
+	}
+	return nil
+}
+
+// upload will PUT the data from r to the target URL. The body can't always be sent again, so if digest authentication
+// is used then the challenge is requested or refreshed first with an authenticated PROPFIND of the collection. If the
+// server still asks for digest authentication, such as for a stale nonce, the PUT is only retried if r can be rewound.
+func (d *webdavDestination) upload(ctx context.Context, target string, collection string, r io.Reader, size int64) error {
+	if d.config.Auth == "digest" {
+		headers := map[string]string{
+			"Depth":        "0",
+			"Content-Type": "application/xml; charset=utf-8",
+		}
+		response, err := d.do(ctx, "PROPFIND", d.collectionURL(collection), headers, []byte(propfindBody))
+		if err != nil {
+			return err
+		}
+		if err := expectStatus(response, http.StatusMultiStatus); err != nil {
+			return fmt.Errorf("error requesting digest challenge: %w", err)
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		request, err := http.NewRequestWithContext(ctx, "PUT", target, io.NopCloser(r))
+		if err != nil {
+			return err
+		}
+		request.ContentLength = size
+		if err := d.authorize(request); err != nil {
+			return err
+		}
+		response, err := d.client.Do(request)
+		if err != nil {
+			return err
+		}
+		if response.StatusCode == http.StatusUnauthorized && attempt == 0 && d.updateChallenge(response) {
+			if seeker, ok := r.(io.Seeker); ok {
+				response.Body.Close()
+				if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		return expectStatus(response, http.StatusOK, http.StatusCreated, http.StatusNoContent)
+	}
+}
+
+func (d *webdavDestination) Get(ctx context.Context, key string, w io.Writer) error {
+	target, err := d.keyURL(key)
+	if err != nil {
+		return err
+	}
+	response, err := d.do(ctx, "GET", target, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("http %d", response.StatusCode)
+	}
+	_, err = io.Copy(w, response.Body)
+	return err
+}
+
+// davEntry describes a member of a collection
+type davEntry struct {
+	key          string
+	isCollection bool
+}
+
+const propfindBody = `<?xml version="1.0" encoding="utf-8"?><propfind xmlns="DAV:"><prop><resourcetype/></prop></propfind>`
+
+// members returns the members of the collection with the given key. Returns nil if the collection does not exist.
+func (d *webdavDestination) members(ctx context.Context, key string) ([]davEntry, error) {
+	headers := map[string]string{
+		"Depth":        "1",
+		"Content-Type": "application/xml; charset=utf-8",
+	}
+	response, err := d.do(ctx, "PROPFIND", d.collectionURL(key), headers, []byte(propfindBody))
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if response.StatusCode != http.StatusMultiStatus {
+		return nil, fmt.Errorf("http %d", response.StatusCode)
+	}
+
+	type multistatus struct {
+		Responses []struct {
+			Href     string `xml:"DAV: href"`
+			Propstat []struct {
+				Prop struct {
+					ResourceType struct {
+						Collection *struct{} `xml:"DAV: collection"`
+					} `xml:"DAV: resourcetype"`
+				} `xml:"DAV: prop"`
+			} `xml:"DAV: propstat"`
+		} `xml:"DAV: response"`
+	}
+	result := multistatus{}
+	if err := xml.NewDecoder(response.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+
+	entries := []davEntry{}
+	for _, member := range result.Responses {
+		u, err := url.Parse(member.Href)
+		if err != nil || !strings.HasPrefix(u.Path, d.base.Path) {
+			continue
+		}
+		memberKey := strings.Trim(strings.TrimPrefix(u.Path, d.base.Path), "/")
+		if memberKey == key {
+			continue
+		}
+		isCollection := false
+		for _, propstat := range member.Propstat {
+			if propstat.Prop.ResourceType.Collection != nil {
+				isCollection = true
+			}
+		}
+		entries = append(entries, davEntry{key: memberKey, isCollection: isCollection})
+	}
+	return entries, nil
+}
+
+func (d *webdavDestination) List(ctx context.Context, prefix string) ([]string, error) {
+	// Only walk the collections that can contain the prefix, starting from the deepest one
+	start := ""
+	if i := strings.LastIndex(prefix, "/"); i > 0 {
+		start = strings.Trim(path.Clean("/"+prefix[:i]), "/")
+	}
+
+	keys := []string{}
+	pending := []string{start}
+	for len(pending) > 0 {
+		collection := pending[0]
+		pending = pending[1:]
+		entries, err := d.members(ctx, collection)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if entry.isCollection {
+				if strings.HasPrefix(prefix, entry.key+"/") || strings.HasPrefix(entry.key+"/", prefix) {
+					pending = append(pending, entry.key)
+				}
+				continue
+			}
+			if strings.HasSuffix(entry.key, ".tmp") || !strings.HasPrefix(entry.key, prefix) {
+				continue
+			}
+			keys = append(keys, entry.key)
+		}
+	}
+	return keys, nil
+}
+
+func (d *webdavDestination) Delete(ctx context.Context, key string) error {
+	target, err := d.keyURL(key)
+	if err != nil {
+		return err
+	}
+	response, err := d.do(ctx, "DELETE", target, nil, nil)
+	if err != nil {
+		return err
+	}
+	if err := expectStatus(response, http.StatusOK, http.StatusNoContent, http.StatusNotFound); err != nil {
+		return err
+	}
+
+	// Remove any collections left empty, but never the base collection. Deleting a collection also deletes everything
+	// in it, so each collection is checked first.
+	for dir := path.Dir(path.Clean("/" + key)[1:]); dir != "."; dir = path.Dir(dir) {
+		entries, err := d.members(ctx, dir)
+		if err != nil || len(entries) > 0 {
+			break
+		}
+		response, err := d.do(ctx, "DELETE", d.collectionURL(dir), nil, nil)
+		if err != nil || expectStatus(response, http.StatusOK, http.StatusNoContent, http.StatusNotFound) != nil {
+			break
+		}
+		d.lock.Lock()
+		delete(d.collections, dir)
+		d.lock.Unlock()
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package pukcab
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// DryRunModule describes an optional interface for modules that can describe what they would back up without saving
+// anything. DryRun may connect to remote hosts to find out what would be saved, but must not create any artifacts or
+// otherwise change anything.
+type DryRunModule interface {
+	DryRun(ctx context.Context, instance *Instance, c interface{}) ([]PlannedArtifact, error)
+}
+
+// PlannedArtifact describes an artifact that a module would save
+type PlannedArtifact struct {
+	// The path where the artifact would be saved
+	Path string
+	// Optional description of where this file would come from, such as a URL or host name
+	Source string
+	// The expected size of the artifact, or 0 if not known
+	Size uint64
+}
+
+// IsDryRun returns true if pukcab was configured for a dry run, where no artifacts are saved or removed
+func IsDryRun() bool {
+	return pukcabConfig != nil && pukcabConfig.DryRun
+}
+
+// dryRunModule asks the module what it would save, without running it
+func dryRunModule(ctx context.Context, module ContextModule, instance *Instance, c interface{}) ([]PlannedArtifact, error) {
+	dryRunner, ok := module.(DryRunModule)
+	if !ok {
+		return nil, fmt.Errorf("module %s does not support dry runs", module.Name())
+	}
+	return dryRunner.DryRun(ctx, instance, c)
+}
+
+// dryRunResult completes the result of a dry run with the artifacts the module would save, after they pass through the
+// processor pipeline
+func dryRunResult(ctx context.Context, module ContextModule, instance *Instance, c interface{}, pipeline []ProcessorType, result *RunResult) *RunResult {
+	planned, err := dryRunModule(ctx, module, instance, c)
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		if err != nil {
+			err = fmt.Errorf("%w (%s)", ctxErr, err.Error())
+		} else {
+			err = ctxErr
+		}
+	}
+	if err != nil {
+		err = redactError(err)
+		log.PError("Error planning module", map[string]interface{}{
+			"module_name": result.ModuleName,
+			"instance":    result.Instance,
+			"error":       err.Error(),
+		})
+		result.Error = fmt.Errorf("module %s: %w", result.Instance, err)
+	}
+	for _, artifact := range planned {
+		artifact.Source = RedactSecrets(artifact.Source)
+		filePaths, err := planProcessors(instance, pipeline, artifact.Path)
+		if err != nil {
+			log.PError("Error planning processors", map[string]interface{}{
+				"module_name": result.ModuleName,
+				"instance":    result.Instance,
+				"file_path":   artifact.Path,
+				"error":       err.Error(),
+			})
+			if result.Error == nil {
+				result.Error = fmt.Errorf("module %s: %w", result.Instance, err)
+			}
+			continue
+		}
+		for i, filePath := range filePaths {
+			planned := PlannedArtifact{Path: filePath}
+			if i == 0 {
+				planned.Source = artifact.Source
+				planned.Size = artifact.Size
+			}
+			log.PInfo("Backup artifact planned", map[string]interface{}{
+				"module_name": result.ModuleName,
+				"instance":    result.Instance,
+				"file_path":   planned.Path,
+				"source":      planned.Source,
+			})
+			result.Planned = append(result.Planned, planned)
+		}
+	}
+	result.End = time.Now()
+	return result
+}
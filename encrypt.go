@@ -0,0 +1,370 @@
+package pukcab
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"filippo.io/age"
+)
+
+// Encryption methods
+const (
+	// Encrypt artifacts to age recipients
+	EncryptionAge = "age"
+	// Encrypt artifacts to OpenPGP recipients using gpg
+	EncryptionOpenPGP = "openpgp"
+	// Don't encrypt artifacts, used to turn off encryption for a module when it is set globally
+	EncryptionNone = "none"
+)
+
+// EncryptionConfig describes how artifacts are encrypted after a module saves them
+type EncryptionConfig struct {
+	// The encryption method, such as "age"
+	Method string `json:"method"`
+	// The public keys to encrypt to. For age these are age1... recipients, for OpenPGP any key ID, fingerprint, or
+	// email address of a public key in the gpg keyring.
+	Recipients []string `json:"recipients"`
+	// Optional path of the gpg binary, if omitted gpg is searched for in $PATH
+	GPGPath string `json:"gpg_path"`
+	// Optional gpg home directory containing the keyring
+	GPGHome string `json:"gpg_home"`
+}
+
+// ArtifactEncryption describes how an artifact was encrypted
+type ArtifactEncryption struct {
+	Method     string   `json:"method"`
+	Recipients []string `json:"recipients"`
+	// The size and SHA-256 checksum of the artifact before it was encrypted
+	PlainSize   uint64 `json:"plain_size"`
+	PlainSHA256 string `json:"plain_sha256"`
+}
+
+// encryptionConfig returns the encryption config for the module instance, or nil if artifacts are not encrypted
+func encryptionConfig(instance ModuleType) *EncryptionConfig {
+	config := pukcabConfig.Encryption
+	if instance.Encryption != nil {
+		config = instance.Encryption
+	}
+	if config == nil || config.Method == EncryptionNone {
+		return nil
+	}
+	return config
+}
+
+// encryptedFileExtension returns the extension added to the name of artifacts encrypted with the given method
+func encryptedFileExtension(method string) string {
+	if method == EncryptionOpenPGP {
+		return ".gpg"
+	}
+	return "." + method
+}
+
+// validateEncryption checks an encryption config for problems. fieldPrefix is added to the name of each field.
+func validateEncryption(label string, fieldPrefix string, config EncryptionConfig) ConfigErrors {
+	errs := ConfigErrors{}
+	switch config.Method {
+	case EncryptionNone:
+		return errs
+	case EncryptionAge:
+		for _, recipient := range config.Recipients {
+			if _, err := age.ParseX25519Recipient(recipient); err != nil {
+				errs = append(errs, FieldError{label, fieldPrefix + "recipients", fmt.Sprintf("'%s' is not a valid age recipient", recipient)})
+			}
+		}
+	case EncryptionOpenPGP:
+	default:
+		errs = append(errs, FieldError{label, fieldPrefix + "method", fmt.Sprintf("'%s' is not a known encryption method", config.Method)})
+		return errs
+	}
+	if len(config.Recipients) == 0 {
+		errs = append(errs, FieldError{label, fieldPrefix + "recipients", "must have at least one recipient"})
+	}
+	return errs
+}
+
+// encryptProcessor encrypts each artifact, replacing the original. Its config is an EncryptionConfig.
+type encryptProcessor struct{}
+
+func (p encryptProcessor) Name() string {
+	return encryptProcessorName
+}
+
+func (p encryptProcessor) Process(ctx context.Context, instance *Instance, artifact Artifact, c interface{}) ([]Artifact, error) {
+	config := EncryptionConfig{}
+	if err := MarshallConfig(c, &config); err != nil {
+		return nil, fmt.Errorf("invalid config for processor: %w", err)
+	}
+	if config.Method == EncryptionNone {
+		return []Artifact{artifact}, nil
+	}
+	encrypted, err := encryptArtifact(ctx, config, artifact)
+	if err != nil {
+		return nil, err
+	}
+	return []Artifact{encrypted}, nil
+}
+
+func (p encryptProcessor) Plan(instance *Instance, filePath string, c interface{}) ([]string, error) {
+	config := EncryptionConfig{}
+	if err := MarshallConfig(c, &config); err != nil {
+		return nil, fmt.Errorf("invalid config for processor: %w", err)
+	}
+	if config.Method == EncryptionNone {
+		return []string{filePath}, nil
+	}
+	return []string{filePath + encryptedFileExtension(config.Method)}, nil
+}
+
+// Validate checks the processor config for problems
+func (p encryptProcessor) Validate(c interface{}) error {
+	config := EncryptionConfig{}
+	if err := MarshallConfig(c, &config); err != nil {
+		return fmt.Errorf("%s: %w", encryptProcessorName, err)
+	}
+	return validateEncryption(encryptProcessorName, "", config).Err()
+}
+
+// encryptArtifact will encrypt the artifact and replace it with the encrypted copy, which is saved with an extension
+// for the encryption method. The plaintext is only removed once the encrypted copy is in place.
+func encryptArtifact(ctx context.Context, config EncryptionConfig, artifact Artifact) (Artifact, error) {
+	encryptedPath := artifact.Path + encryptedFileExtension(config.Method)
+	f, err := os.CreateTemp(path.Dir(encryptedPath), TempPattern(encryptedPath))
+	if err != nil {
+		return artifact, err
+	}
+	tmpPath := f.Name()
+
+	switch config.Method {
+	case EncryptionAge:
+		err = encryptAge(artifact.Path, f, config.Recipients)
+	case EncryptionOpenPGP:
+		err = encryptOpenPGP(ctx, artifact.Path, tmpPath, config)
+	default:
+		err = fmt.Errorf("'%s' is not a known encryption method", config.Method)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	var checksum string
+	var info os.FileInfo
+	if err == nil {
+		err = os.Chmod(tmpPath, 0644)
+	}
+	if err == nil {
+		checksum, err = hashFile(tmpPath)
+	}
+	if err == nil {
+		info, err = os.Stat(tmpPath)
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, encryptedPath)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return artifact, err
+	}
+	if err := os.Remove(artifact.Path); err != nil {
+		return artifact, err
+	}
+
+	return Artifact{
+		Path:       encryptedPath,
+		Size:       uint64(info.Size()),
+		SHA256:     checksum,
+		Source:     artifact.Source,
+		Processors: artifact.Processors,
+		Encryption: &ArtifactEncryption{
+			Method:      config.Method,
+			Recipients:  config.Recipients,
+			PlainSize:   artifact.Size,
+			PlainSHA256: artifact.SHA256,
+		},
+	}, nil
+}
+
+func encryptAge(plainPath string, w io.Writer, recipientKeys []string) error {
+	recipients := make([]age.Recipient, len(recipientKeys))
+	for i, key := range recipientKeys {
+		recipient, err := age.ParseX25519Recipient(key)
+		if err != nil {
+			return err
+		}
+		recipients[i] = recipient
+	}
+
+	plain, err := os.Open(plainPath)
+	if err != nil {
+		return err
+	}
+	defer plain.Close()
+
+	encrypter, err := age.Encrypt(w, recipients...)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(encrypter, plain); err != nil {
+		return err
+	}
+	return encrypter.Close()
+}
+
+func encryptOpenPGP(ctx context.Context, plainPath string, encryptedPath string, config EncryptionConfig) error {
+	// Recipients must already be in the keyring, gpg must not look them up over the network
+	args := []string{"--batch", "--yes", "--trust-model", "always", "--auto-key-locate", "local", "--output", encryptedPath}
+	for _, recipient := range config.Recipients {
+		args = append(args, "--recipient", recipient)
+	}
+	args = append(args, "--encrypt", plainPath)
+	return runGPG(ctx, config.GPGPath, config.GPGHome, args, nil)
+}
+
+// runGPG runs gpg with the given arguments, writing its output to stdout if set
+func runGPG(ctx context.Context, gpgPath string, gpgHome string, args []string, stdout io.Writer) error {
+	if gpgPath == "" {
+		p, err := exec.LookPath("gpg")
+		if err != nil {
+			return fmt.Errorf("no gpg bin found")
+		}
+		gpgPath = p
+	}
+	if gpgHome != "" {
+		args = append([]string{"--homedir", gpgHome}, args...)
+	}
+
+	stderr := &bytes.Buffer{}
+	cmd := exec.CommandContext(ctx, gpgPath, args...)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("gpg: %w: %s", err, strings.ReplaceAll(strings.TrimSpace(stderr.String()), "\n", "; "))
+	}
+	return nil
+}
+
+// DecryptOptions describes the keys used to decrypt an artifact
+type DecryptOptions struct {
+	// The path of a file containing age identities (private keys), required for age encrypted artifacts
+	IdentityFile string
+	// Optional path of the gpg binary, if omitted gpg is searched for in $PATH
+	GPGPath string
+	// Optional gpg home directory containing the keyring
+	GPGHome string
+}
+
+// DecryptArtifact will decrypt the encrypted artifact at filePath to targetPath, which must not already exist. If the
+// manifest in the directory of the artifact describes how it was encrypted then the decrypted copy is checked against
+// the size and checksum of the original artifact, otherwise the encryption method is determined by the file extension.
+func DecryptArtifact(ctx context.Context, filePath string, targetPath string, options DecryptOptions) error {
+	encryption := artifactEncryption(filePath)
+	method := ""
+	if encryption != nil {
+		method = encryption.Method
+	} else {
+		switch strings.ToLower(path.Ext(filePath)) {
+		case ".age":
+			method = EncryptionAge
+		case ".gpg", ".pgp", ".asc":
+			method = EncryptionOpenPGP
+		default:
+			return fmt.Errorf("%s is not an encrypted artifact", filePath)
+		}
+	}
+
+	target, err := os.OpenFile(targetPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	counter := &countingWriter{}
+	w := io.MultiWriter(target, h, counter)
+	switch method {
+	case EncryptionAge:
+		err = decryptAge(filePath, w, options.IdentityFile)
+	case EncryptionOpenPGP:
+		err = runGPG(ctx, options.GPGPath, options.GPGHome, []string{"--batch", "--decrypt", filePath}, w)
+	default:
+		err = fmt.Errorf("'%s' is not a known encryption method", method)
+	}
+	if closeErr := target.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && encryption != nil && (counter.n != encryption.PlainSize || hex.EncodeToString(h.Sum(nil)) != encryption.PlainSHA256) {
+		err = fmt.Errorf("decrypted artifact does not match the manifest")
+	}
+	if err != nil {
+		os.Remove(targetPath)
+		return err
+	}
+	log.PInfo("Decrypted artifact", map[string]interface{}{
+		"file_path":   filePath,
+		"target_path": targetPath,
+		"method":      method,
+	})
+	return nil
+}
+
+func decryptAge(filePath string, w io.Writer, identityFile string) error {
+	if identityFile == "" {
+		return fmt.Errorf("an identity file is required to decrypt age artifacts")
+	}
+	identitiesFile, err := os.Open(identityFile)
+	if err != nil {
+		return err
+	}
+	identities, err := age.ParseIdentities(identitiesFile)
+	identitiesFile.Close()
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r, err := age.Decrypt(f, identities...)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	return err
+}
+
+// artifactEncryption returns how the artifact at filePath was encrypted according to the manifest in its directory,
+// or nil if it isn't known
+func artifactEncryption(filePath string) *ArtifactEncryption {
+	absPath, err := filepath.Abs(filePath)
+	if err != nil {
+		return nil
+	}
+	// Artifacts may be in a subdirectory of the run directory, so check each parent directory for a manifest
+	for dir := filepath.Dir(absPath); dir != filepath.Dir(dir); dir = filepath.Dir(dir) {
+		manifest, err := ReadManifest(dir)
+		if err != nil {
+			continue
+		}
+		// Later runs on the same day replace artifacts with the same name
+		var encryption *ArtifactEncryption
+		for _, run := range manifest.Runs {
+			for _, file := range run.Files {
+				if filepath.Join(dir, file.Name) == absPath {
+					encryption = file.Encryption
+				}
+			}
+		}
+		return encryption
+	}
+	return nil
+}
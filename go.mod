@@ -2,4 +2,13 @@ module github.com/ecnepsnai/pukcab
 
 go 1.16
 
-require github.com/ecnepsnai/logtic v1.9.2
+require (
+	filippo.io/age v1.0.0
+	github.com/BurntSushi/toml v1.2.1
+	github.com/ecnepsnai/logtic v1.9.2
+	github.com/klauspost/compress v1.15.9
+	github.com/pkg/sftp v1.13.4
+	github.com/ulikunitz/xz v0.5.11
+	golang.org/x/crypto v0.0.0-20210921155107-089bfa567519
+	gopkg.in/yaml.v3 v3.0.1
+)
@@ -0,0 +1,129 @@
+package pukcab
+
+import (
+	"os"
+	"path"
+	"sort"
+)
+
+// SavedRun describes a previous run of a module instance that was recorded in a manifest
+type SavedRun struct {
+	// The path of the run directory
+	Dir string
+	// The run as recorded in the manifest of the run directory
+	ManifestRun
+}
+
+// OK returns true if the run finished without an error
+func (r SavedRun) OK() bool {
+	return r.Error == ""
+}
+
+// InstanceStatus describes the saved runs of a module instance
+type InstanceStatus struct {
+	// The name of the module
+	Module string
+	// The label of the module instance
+	Instance string
+	// The number of saved runs
+	Runs int
+	// The most recent run, or nil if the instance has never run
+	LastRun *SavedRun
+	// The number of artifacts of the most recent run, including artifacts kept from earlier runs because they were
+	// unchanged
+	LastRunArtifacts int
+	// The most recent run that finished without an error, or nil if there have been none
+	LastSuccess *SavedRun
+}
+
+// SavedRuns returns every run of the given module instance that was recorded in a manifest and still exists in the
+// output directory, sorted oldest first
+func SavedRuns(module ContextModule, instance ModuleType) ([]SavedRun, error) {
+	outputDir, err := instanceOutputDir(module, instance)
+	if err != nil {
+		return nil, err
+	}
+	items, err := os.ReadDir(outputDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []SavedRun{}, nil
+		}
+		return nil, err
+	}
+
+	label := instance.Label()
+	runs := []SavedRun{}
+	for _, item := range items {
+		if !item.IsDir() {
+			continue
+		}
+		runDir := path.Join(outputDir, item.Name())
+		manifest, err := ReadManifest(runDir)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				log.PWarn("Error reading manifest", map[string]interface{}{
+					"run_dir": runDir,
+					"error":   err.Error(),
+				})
+			}
+			continue
+		}
+		for _, run := range manifest.Runs {
+			if run.Module != module.Name() || run.Instance != label {
+				continue
+			}
+			runs = append(runs, SavedRun{Dir: runDir, ManifestRun: run})
+		}
+	}
+
+	sort.SliceStable(runs, func(i, j int) bool {
+		return runs[i].Start.Before(runs[j].Start)
+	})
+	return runs, nil
+}
+
+// runArtifacts returns the artifacts of the run at index i of runs, which are sorted oldest first. When unchanged
+// artifacts are discarded a run only lists the artifacts that changed, so the latest copy of each other artifact from
+// an earlier run is included as well.
+func runArtifacts(runs []SavedRun, i int, instance ModuleType) []previousArtifact {
+	files := []previousArtifact{}
+	if changes := changeDetectionConfig(instance); changes != nil && changes.Unchanged == UnchangedDiscard {
+		for _, file := range latestArtifacts(runs[:i+1]) {
+			files = append(files, file)
+		}
+		sort.Slice(files, func(a, b int) bool {
+			return files[a].File.Name < files[b].File.Name
+		})
+		return files
+	}
+	for _, file := range runs[i].Files {
+		files = append(files, previousArtifact{Dir: runs[i].Dir, File: file})
+	}
+	return files
+}
+
+// Status returns the status of the given module instance from its saved runs
+func Status(module ContextModule, instance ModuleType) (*InstanceStatus, error) {
+	runs, err := SavedRuns(module, instance)
+	if err != nil {
+		return nil, err
+	}
+
+	status := &InstanceStatus{
+		Module:   module.Name(),
+		Instance: instance.Label(),
+		Runs:     len(runs),
+	}
+	for i := len(runs) - 1; i >= 0; i-- {
+		run := runs[i]
+		if status.LastRun == nil {
+			status.LastRun = &run
+			status.LastRunArtifacts = len(runArtifacts(runs, i, instance))
+		}
+		if run.OK() {
+			status.LastSuccess = &run
+			break
+		}
+	}
+	return status, nil
+}
@@ -0,0 +1,206 @@
+package pukcab
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ManifestFileName is the name of the manifest file written to each run directory
+const ManifestFileName = "manifest.json"
+
+// Manifest describes every module run that saved artifacts to a run directory
+type Manifest struct {
+	Runs []ManifestRun `json:"runs"`
+}
+
+// ManifestRun describes a single module run in a manifest
+type ManifestRun struct {
+	Module            string         `json:"module"`
+	Instance          string         `json:"instance"`
+	RunID             string         `json:"run_id"`
+	ConfigFingerprint string         `json:"config_fingerprint"`
+	Start             time.Time      `json:"start"`
+	End               time.Time      `json:"end"`
+	Duration          string         `json:"duration"`
+	Error             string         `json:"error,omitempty"`
+	Files             []ManifestFile `json:"files"`
+}
+
+// ManifestFile describes a single artifact in a manifest
+type ManifestFile struct {
+	// The path of the artifact relative to the run directory
+	Name   string `json:"name"`
+	Size   uint64 `json:"size"`
+	SHA256 string `json:"sha256"`
+	Source string `json:"source,omitempty"`
+	// How the artifact was encrypted, if it was. Size and SHA256 describe the encrypted artifact.
+	Encryption *ArtifactEncryption `json:"encryption,omitempty"`
+	// The names of the processors that were applied to the artifact, in order
+	Processors []string `json:"processors,omitempty"`
+	// Set by change detection if the artifact was identical to, or differed from, the previous copy of the artifact
+	Unchanged bool `json:"unchanged,omitempty"`
+	Changed   bool `json:"changed,omitempty"`
+}
+
+var manifestLock = &sync.Mutex{}
+
+// ReadManifest will read the manifest from the given run directory
+func ReadManifest(runDir string) (*Manifest, error) {
+	f, err := os.Open(path.Join(runDir, ManifestFileName))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	manifest := Manifest{}
+	if err := json.NewDecoder(f).Decode(&manifest); err != nil {
+		return nil, err
+	}
+	return &manifest, nil
+}
+
+// appendManifest will add the run to the manifest in the given run directory, creating the manifest if needed
+func appendManifest(runDir string, run ManifestRun) error {
+	manifestLock.Lock()
+	defer manifestLock.Unlock()
+
+	manifest, err := ReadManifest(runDir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.PError("Error reading existing manifest", map[string]interface{}{
+				"run_dir": runDir,
+				"error":   err.Error(),
+			})
+			return err
+		}
+		manifest = &Manifest{}
+	}
+	manifest.Runs = append(manifest.Runs, run)
+
+	data, err := json.MarshalIndent(manifest, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	manifestPath := path.Join(runDir, ManifestFileName)
+	tmpPath := manifestPath + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		log.PError("Error writing manifest", map[string]interface{}{
+			"file_path": tmpPath,
+			"error":     err.Error(),
+		})
+		return err
+	}
+	if err := os.Rename(tmpPath, manifestPath); err != nil {
+		log.PError("Error writing manifest", map[string]interface{}{
+			"file_path": manifestPath,
+			"error":     err.Error(),
+		})
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
+
+// manifestRunFromResult will prepare a manifest run from the given run result
+func manifestRunFromResult(result *RunResult, config interface{}) ManifestRun {
+	run := ManifestRun{
+		Module:            result.ModuleName,
+		Instance:          result.Instance,
+		RunID:             runID,
+		ConfigFingerprint: configFingerprint(config),
+		Start:             result.Start,
+		End:               result.End,
+		Duration:          result.Duration().String(),
+		Files:             []ManifestFile{},
+	}
+	if result.Error != nil {
+		run.Error = result.Error.Error()
+	}
+	for _, artifact := range result.Artifacts {
+		name, err := filepath.Rel(result.Dir, artifact.Path)
+		if err != nil || strings.HasPrefix(name, "..") {
+			name = artifact.Path
+		}
+		run.Files = append(run.Files, ManifestFile{
+			Name:       name,
+			Size:       artifact.Size,
+			SHA256:     artifact.SHA256,
+			Source:     artifact.Source,
+			Encryption: artifact.Encryption,
+			Processors: artifact.Processors,
+			Unchanged:  artifact.Unchanged,
+			Changed:    artifact.Changed,
+		})
+	}
+	return run
+}
+
+// configFingerprint returns a SHA-256 checksum of the given module config with any secrets redacted
+func configFingerprint(config interface{}) string {
+	data, err := json.Marshal(redactConfig(config))
+	if err != nil {
+		return ""
+	}
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:])
+}
+
+// redactedKeywords are substrings of config keys that are considered secret
+var redactedKeywords = []string{"password", "secret", "token", "key"}
+
+// redactConfig returns a copy of the given module config with the values of any secret keys replaced
+func redactConfig(config interface{}) interface{} {
+	switch c := config.(type) {
+	case map[string]interface{}:
+		redacted := map[string]interface{}{}
+		for k, v := range c {
+			if isSecretKey(k) {
+				redacted[k] = "[REDACTED]"
+				continue
+			}
+			redacted[k] = redactConfig(v)
+		}
+		return redacted
+	case []interface{}:
+		redacted := make([]interface{}, len(c))
+		for i, v := range c {
+			redacted[i] = redactConfig(v)
+		}
+		return redacted
+	}
+	return config
+}
+
+func isSecretKey(key string) bool {
+	key = strings.ToLower(key)
+	for _, keyword := range redactedKeywords {
+		if strings.Contains(key, keyword) {
+			return true
+		}
+	}
+	return false
+}
+
+// hashFile returns the hex-encoded SHA-256 checksum of the file at the given path
+func hashFile(filePath string) (string, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
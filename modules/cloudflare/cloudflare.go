@@ -1,11 +1,11 @@
 package cloudflare
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
-	"os"
 
 	"github.com/ecnepsnai/pukcab"
 )
@@ -15,10 +15,10 @@ type cloudflareZone struct {
 	Name string `json:"name"`
 }
 
-func getZones(creds CloudflareConfig) ([]cloudflareZone, error) {
-	request, err := http.NewRequest("GET", "https://api.cloudflare.com/client/v4/zones", nil)
+func getZones(ctx context.Context, instance *pukcab.Instance, creds CloudflareConfig) ([]cloudflareZone, error) {
+	request, err := http.NewRequestWithContext(ctx, "GET", "https://api.cloudflare.com/client/v4/zones", nil)
 	if err != nil {
-		log.Error("Error forming zones request: error='%s'", err.Error())
+		instance.Log.Error("Error forming zones request: error='%s'", err.Error())
 		return nil, err
 	}
 	request.Header.Add("X-Auth-Key", creds.APIKey)
@@ -26,11 +26,12 @@ func getZones(creds CloudflareConfig) ([]cloudflareZone, error) {
 
 	response, err := http.DefaultClient.Do(request)
 	if err != nil {
-		log.Error("Error making zone list request: error='%s'", err.Error())
+		instance.Log.Error("Error making zone list request: error='%s'", err.Error())
 		return nil, err
 	}
+	defer response.Body.Close()
 	if response.StatusCode != 200 {
-		log.Error("Error making zone list request: error='http %d'", response.StatusCode)
+		instance.Log.Error("Error making zone list request: error='http %d'", response.StatusCode)
 		return nil, fmt.Errorf("http %d", response.StatusCode)
 	}
 
@@ -39,17 +40,17 @@ func getZones(creds CloudflareConfig) ([]cloudflareZone, error) {
 	}
 	result := zoneResponse{}
 	if err := json.NewDecoder(response.Body).Decode(&result); err != nil {
-		log.Error("Error decoding zone list request: error='%s'", err.Error())
+		instance.Log.Error("Error decoding zone list request: error='%s'", err.Error())
 		return nil, err
 	}
 
 	return result.Result, nil
 }
 
-func downloadZoneFile(creds CloudflareConfig, zone cloudflareZone) (*pukcab.File, error) {
-	request, err := http.NewRequest("GET", "https://api.cloudflare.com/client/v4/zones/"+zone.ID+"/dns_records/export", nil)
+func downloadZoneFile(ctx context.Context, instance *pukcab.Instance, creds CloudflareConfig, zone cloudflareZone) (*pukcab.File, error) {
+	request, err := http.NewRequestWithContext(ctx, "GET", "https://api.cloudflare.com/client/v4/zones/"+zone.ID+"/dns_records/export", nil)
 	if err != nil {
-		log.Error("Error forming zones request: error='%s'", err.Error())
+		instance.Log.Error("Error forming zones request: error='%s'", err.Error())
 		return nil, err
 	}
 	request.Header.Add("X-Auth-Key", creds.APIKey)
@@ -57,28 +58,33 @@ func downloadZoneFile(creds CloudflareConfig, zone cloudflareZone) (*pukcab.File
 
 	response, err := http.DefaultClient.Do(request)
 	if err != nil {
-		log.Error("Error making zone list request: error='%s'", err.Error())
+		instance.Log.Error("Error making zone list request: error='%s'", err.Error())
 		return nil, err
 	}
+	defer response.Body.Close()
 	if response.StatusCode != 200 {
-		log.Error("Error making zone list request: error='http %d'", response.StatusCode)
+		instance.Log.Error("Error making zone list request: error='http %d'", response.StatusCode)
 		return nil, fmt.Errorf("http %d", response.StatusCode)
 	}
 
-	filePath := pukcab.GetFilePath(Name, zone.Name+".txt")
-	f, err := os.OpenFile(filePath, os.O_CREATE|os.O_WRONLY, 0644)
+	w, err := pukcab.CreateArtifact(instance, zoneFileName(zone))
 	if err != nil {
-		log.Error("Error opening destination file: file_path='%s' error='%s'", filePath, err.Error())
 		return nil, err
 	}
-	defer f.Close()
-
-	if _, err := io.Copy(f, response.Body); err != nil {
-		log.Error("Error writing backup file: file_path='%s' error='%s'", filePath, err.Error())
+	if _, err := io.Copy(w, response.Body); err != nil {
+		instance.Log.Error("Error writing backup file: file_path='%s' error='%s'", w.Path(), err.Error())
+		w.Abort()
+		return nil, err
+	}
+	file, err := w.Commit()
+	if err != nil {
 		return nil, err
 	}
 
-	return &pukcab.File{
-		Path: filePath,
-	}, nil
+	file.Source = "zone " + zone.Name
+	return file, nil
+}
+
+func zoneFileName(zone cloudflareZone) string {
+	return zone.Name + ".txt"
 }
@@ -1,14 +1,12 @@
 package cloudflare
 
 import (
+	"context"
 	"fmt"
 
-	"github.com/ecnepsnai/logtic"
 	"github.com/ecnepsnai/pukcab"
 )
 
-var log = logtic.Log.Connect("pukcab/cloudflare")
-
 const Name = "cloudflare"
 
 type CloudflareConfig struct {
@@ -23,25 +21,70 @@ func (m CloudflareModule) Name() string {
 	return Name
 }
 
-func (m CloudflareModule) Run(c interface{}) ([]pukcab.File, error) {
+func (m CloudflareModule) RunContext(ctx context.Context, instance *pukcab.Instance, c interface{}) ([]pukcab.File, error) {
 	config := CloudflareConfig{}
 	if err := pukcab.MarshallConfig(c, &config); err != nil {
-		return nil, fmt.Errorf("invalid config for module")
+		return nil, fmt.Errorf("invalid config for module: %w", err)
 	}
 
-	zones, err := getZones(config)
+	zones, err := getZones(ctx, instance, config)
 	if err != nil {
 		return nil, err
 	}
 
 	files := []pukcab.File{}
 	for _, zone := range zones {
-		file, err := downloadZoneFile(config, zone)
+		file, err := downloadZoneFile(ctx, instance, config, zone)
 		if err != nil {
-			return nil, err
+			// Keep the zones that were already downloaded
+			return files, err
 		}
 		files = append(files, *file)
 	}
 
 	return files, nil
 }
+
+// DryRun lists the zones in the account without downloading them
+func (m CloudflareModule) DryRun(ctx context.Context, instance *pukcab.Instance, c interface{}) ([]pukcab.PlannedArtifact, error) {
+	config := CloudflareConfig{}
+	if err := pukcab.MarshallConfig(c, &config); err != nil {
+		return nil, fmt.Errorf("invalid config for module: %w", err)
+	}
+
+	zones, err := getZones(ctx, instance, config)
+	if err != nil {
+		return nil, err
+	}
+
+	planned := []pukcab.PlannedArtifact{}
+	for _, zone := range zones {
+		planned = append(planned, pukcab.PlannedArtifact{
+			Path:   pukcab.GetFilePath(instance, zoneFileName(zone)),
+			Source: "zone " + zone.Name,
+		})
+	}
+	return planned, nil
+}
+
+// Validate checks the module config for problems
+func (m CloudflareModule) Validate(c interface{}) error {
+	config := CloudflareConfig{}
+	if err := pukcab.MarshallConfig(c, &config); err != nil {
+		return fmt.Errorf("%s: %w", Name, err)
+	}
+
+	errs := pukcab.ConfigErrors{}
+	if config.Email == "" {
+		errs = append(errs, pukcab.RequiredField(Name, "cloudflare_email"))
+	}
+	if config.APIKey == "" {
+		errs = append(errs, pukcab.RequiredField(Name, "cloudflare_api_key"))
+	}
+	return errs.Err()
+}
+
+// Host returns the host that this module connects to
+func (m CloudflareModule) Host(c interface{}) string {
+	return "api.cloudflare.com"
+}
@@ -1,16 +1,15 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"os/exec"
+	"strings"
 
-	"github.com/ecnepsnai/logtic"
 	"github.com/ecnepsnai/pukcab"
 )
 
-var log = logtic.Log.Connect("pukcab/cmd")
-
 const Name = "cmd"
 
 type CmdConfig struct {
@@ -29,22 +28,18 @@ func (m CmdModule) Name() string {
 	return Name
 }
 
-func (m CmdModule) Run(c interface{}) ([]pukcab.File, error) {
+func (m CmdModule) RunContext(ctx context.Context, instance *pukcab.Instance, c interface{}) ([]pukcab.File, error) {
 	config := CmdConfig{}
 	if err := pukcab.MarshallConfig(c, &config); err != nil {
-		return nil, fmt.Errorf("invalid config for module")
+		return nil, fmt.Errorf("invalid config for module: %w", err)
 	}
 
-	outputFile := pukcab.GetFilePath(Name, config.OutputName)
-	f, err := os.OpenFile(outputFile, os.O_CREATE|os.O_RDWR, os.ModePerm)
+	w, err := pukcab.CreateArtifact(instance, config.OutputName)
 	if err != nil {
-		log.PPanic("Error opening output file", map[string]interface{}{
-			"error": err.Error(),
-		})
+		return nil, err
 	}
-	defer f.Close()
 
-	command := exec.Command(config.ExecPath, config.Args...)
+	command := exec.CommandContext(ctx, config.ExecPath, config.Args...)
 	command.Env = os.Environ()
 	if config.Env != nil {
 		command.Env = append(command.Env, config.Env...)
@@ -52,20 +47,66 @@ func (m CmdModule) Run(c interface{}) ([]pukcab.File, error) {
 	if config.Wd != "" {
 		command.Dir = config.Wd
 	}
-	command.Stdout = f
+	command.Stdout = w
 	if config.IncludeStderr {
-		command.Stderr = f
+		command.Stderr = w
 	} else {
 		command.Stderr = os.Stderr
 	}
 	if err := command.Run(); err != nil {
-		log.PError("Error running command", map[string]interface{}{
+		instance.Log.PError("Error running command", map[string]interface{}{
 			"exec":  config.ExecPath,
-			"args":  config.Args,
+			"args":  pukcab.RedactSecrets(strings.Join(config.Args, " ")),
 			"error": err.Error(),
 		})
+		w.Abort()
+		return nil, err
+	}
+	file, err := w.Commit()
+	if err != nil {
 		return nil, err
 	}
 
-	return []pukcab.File{{Path: outputFile}}, nil
+	file.Source = strings.Join(append([]string{config.ExecPath}, config.Args...), " ")
+	return []pukcab.File{*file}, nil
+}
+
+// DryRun checks that the executable exists without running the command, since it may have side effects
+func (m CmdModule) DryRun(ctx context.Context, instance *pukcab.Instance, c interface{}) ([]pukcab.PlannedArtifact, error) {
+	config := CmdConfig{}
+	if err := pukcab.MarshallConfig(c, &config); err != nil {
+		return nil, fmt.Errorf("invalid config for module: %w", err)
+	}
+
+	if _, err := exec.LookPath(config.ExecPath); err != nil {
+		instance.Log.PError("Executable not found", map[string]interface{}{
+			"exec":  config.ExecPath,
+			"error": err.Error(),
+		})
+		return nil, err
+	}
+
+	return []pukcab.PlannedArtifact{
+		{
+			Path:   pukcab.GetFilePath(instance, config.OutputName),
+			Source: strings.Join(append([]string{config.ExecPath}, config.Args...), " "),
+		},
+	}, nil
+}
+
+// Validate checks the module config for problems
+func (m CmdModule) Validate(c interface{}) error {
+	config := CmdConfig{}
+	if err := pukcab.MarshallConfig(c, &config); err != nil {
+		return fmt.Errorf("%s: %w", Name, err)
+	}
+
+	errs := pukcab.ConfigErrors{}
+	if config.ExecPath == "" {
+		errs = append(errs, pukcab.RequiredField(Name, "exec_path"))
+	}
+	if config.OutputName == "" {
+		errs = append(errs, pukcab.RequiredField(Name, "output_name"))
+	}
+	return errs.Err()
 }
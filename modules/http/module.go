@@ -1,18 +1,16 @@
 package http
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
 	"io"
 	nhttp "net/http"
-	"os"
+	"net/url"
 
-	"github.com/ecnepsnai/logtic"
 	"github.com/ecnepsnai/pukcab"
 )
 
-var log = logtic.Log.Connect("pukcab/http")
-
 const Name = "http"
 
 type HTTPConfig struct {
@@ -29,22 +27,78 @@ func (m HTTPModule) Name() string {
 	return Name
 }
 
-func (m HTTPModule) Run(c interface{}) ([]pukcab.File, error) {
+func (m HTTPModule) RunContext(ctx context.Context, instance *pukcab.Instance, c interface{}) ([]pukcab.File, error) {
 	config := HTTPConfig{}
 	if err := pukcab.MarshallConfig(c, &config); err != nil {
-		return nil, fmt.Errorf("invalid config for module")
+		return nil, fmt.Errorf("invalid config for module: %w", err)
+	}
+
+	resp, err := doRequest(ctx, instance, "GET", config)
+	if err != nil {
+		instance.Log.Error("Error making HTTP request: url='%s' error='%s'", pukcab.RedactSecrets(config.URL), pukcab.RedactSecrets(err.Error()))
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		instance.Log.Error("Error making HTTP request: url='%s' error='http %d'", pukcab.RedactSecrets(config.URL), resp.StatusCode)
+		return nil, fmt.Errorf("http %d", resp.StatusCode)
 	}
 
-	filePath := pukcab.GetFilePath(Name, config.FileName)
-	f, err := os.OpenFile(filePath, os.O_CREATE|os.O_WRONLY, 0644)
+	w, err := pukcab.CreateArtifact(instance, config.FileName)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		instance.Log.Error("Error writing to destination file: file_path='%s' error='%s'", w.Path(), err.Error())
+		w.Abort()
+		return nil, err
+	}
+	file, err := w.Commit()
 	if err != nil {
-		log.Error("Error opening destination file for writing: file_path='%s' error='%s'", filePath, err.Error())
 		return nil, err
 	}
-	defer f.Close()
-	request, err := nhttp.NewRequest("GET", config.URL, nil)
+
+	file.Source = config.URL
+	return []pukcab.File{*file}, nil
+}
+
+// DryRun makes a HEAD request for the URL to check that it can be downloaded
+func (m HTTPModule) DryRun(ctx context.Context, instance *pukcab.Instance, c interface{}) ([]pukcab.PlannedArtifact, error) {
+	config := HTTPConfig{}
+	if err := pukcab.MarshallConfig(c, &config); err != nil {
+		return nil, fmt.Errorf("invalid config for module: %w", err)
+	}
+
+	resp, err := doRequest(ctx, instance, "HEAD", config)
 	if err != nil {
-		log.Error("Error forming HTTP request: url='%s' error='%s'", config.URL, err.Error())
+		instance.Log.Error("Error making HTTP request: url='%s' error='%s'", pukcab.RedactSecrets(config.URL), pukcab.RedactSecrets(err.Error()))
+		return nil, err
+	}
+	resp.Body.Close()
+
+	planned := pukcab.PlannedArtifact{
+		Path:   pukcab.GetFilePath(instance, config.FileName),
+		Source: config.URL,
+	}
+	switch {
+	case resp.StatusCode == 200:
+		if resp.ContentLength > 0 {
+			planned.Size = uint64(resp.ContentLength)
+		}
+	case resp.StatusCode == 405 || resp.StatusCode == 501:
+		// Not all servers support HEAD requests, the size just isn't known
+		instance.Log.Debug("HEAD request not supported: url='%s' status=%d", pukcab.RedactSecrets(config.URL), resp.StatusCode)
+	default:
+		instance.Log.Error("Error making HTTP request: url='%s' error='http %d'", pukcab.RedactSecrets(config.URL), resp.StatusCode)
+		return nil, fmt.Errorf("http %d", resp.StatusCode)
+	}
+	return []pukcab.PlannedArtifact{planned}, nil
+}
+
+func doRequest(ctx context.Context, instance *pukcab.Instance, method string, config HTTPConfig) (*nhttp.Response, error) {
+	request, err := nhttp.NewRequestWithContext(ctx, method, config.URL, nil)
+	if err != nil {
+		instance.Log.Error("Error forming HTTP request: url='%s' error='%s'", pukcab.RedactSecrets(config.URL), pukcab.RedactSecrets(err.Error()))
 		return nil, err
 	}
 	for k, v := range config.Headers {
@@ -58,24 +112,40 @@ func (m HTTPModule) Run(c interface{}) ([]pukcab.File, error) {
 	}
 	client.Transport = tr
 
-	resp, err := client.Do(request)
-	if err != nil {
-		log.Error("Error making HTTP request: url='%s' error='%s'", config.URL, err.Error())
-		return nil, err
-	}
-	if resp.StatusCode != 200 {
-		log.Error("Error making HTTP request: url='%s' error='http %d'", config.URL, resp.StatusCode)
-		return nil, fmt.Errorf("http %d", resp.StatusCode)
+	return client.Do(request)
+}
+
+// Validate checks the module config for problems
+func (m HTTPModule) Validate(c interface{}) error {
+	config := HTTPConfig{}
+	if err := pukcab.MarshallConfig(c, &config); err != nil {
+		return fmt.Errorf("%s: %w", Name, err)
 	}
 
-	if _, err := io.Copy(f, resp.Body); err != nil {
-		log.Error("Error writing to destination file: file_path='%s' error='%s'", filePath, err.Error())
-		return nil, err
+	errs := pukcab.ConfigErrors{}
+	if config.URL == "" {
+		errs = append(errs, pukcab.RequiredField(Name, "url"))
 	}
+	if config.URL != "" && !pukcab.IsSecretReference(config.URL) {
+		if u, err := url.Parse(config.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			errs = append(errs, pukcab.FieldError{Module: Name, Field: "url", Message: "must be a http or https URL"})
+		}
+	}
+	if config.FileName == "" {
+		errs = append(errs, pukcab.RequiredField(Name, "file_name"))
+	}
+	return errs.Err()
+}
 
-	return []pukcab.File{
-		{
-			Path: filePath,
-		},
-	}, nil
+// Host returns the host that this module connects to
+func (m HTTPModule) Host(c interface{}) string {
+	config := HTTPConfig{}
+	if err := pukcab.MarshallConfig(c, &config); err != nil {
+		return ""
+	}
+	u, err := url.Parse(config.URL)
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
 }
@@ -1,14 +1,12 @@
 package pfsense
 
 import (
+	"context"
 	"fmt"
 
-	"github.com/ecnepsnai/logtic"
 	"github.com/ecnepsnai/pukcab"
 )
 
-var log = logtic.Log.Connect("pukcab/pfsense")
-
 const Name = "pfsense"
 
 type PFSenseConfig struct {
@@ -26,16 +24,60 @@ func (m PFSenseModule) Name() string {
 	return Name
 }
 
-func (m PFSenseModule) Run(c interface{}) ([]pukcab.File, error) {
+func (m PFSenseModule) RunContext(ctx context.Context, instance *pukcab.Instance, c interface{}) ([]pukcab.File, error) {
 	config := PFSenseConfig{}
 	if err := pukcab.MarshallConfig(c, &config); err != nil {
-		return nil, fmt.Errorf("invalid config for module")
+		return nil, fmt.Errorf("invalid config for module: %w", err)
 	}
 
-	file, err := runBackup(config)
+	file, err := runBackup(ctx, instance, config)
 	if err != nil {
 		return nil, err
 	}
 
 	return []pukcab.File{*file}, nil
 }
+
+// DryRun describes the backup without connecting to the device, since logging in may trigger a lockout or alert
+func (m PFSenseModule) DryRun(ctx context.Context, instance *pukcab.Instance, c interface{}) ([]pukcab.PlannedArtifact, error) {
+	config := PFSenseConfig{}
+	if err := pukcab.MarshallConfig(c, &config); err != nil {
+		return nil, fmt.Errorf("invalid config for module: %w", err)
+	}
+
+	return []pukcab.PlannedArtifact{
+		{
+			Path:   pukcab.GetFilePath(instance, config.HostAddress+".xml"),
+			Source: config.HostAddress,
+		},
+	}, nil
+}
+
+// Validate checks the module config for problems
+func (m PFSenseModule) Validate(c interface{}) error {
+	config := PFSenseConfig{}
+	if err := pukcab.MarshallConfig(c, &config); err != nil {
+		return fmt.Errorf("%s: %w", Name, err)
+	}
+
+	errs := pukcab.ConfigErrors{}
+	if config.HostAddress == "" {
+		errs = append(errs, pukcab.RequiredField(Name, "host_address"))
+	}
+	if config.Username == "" {
+		errs = append(errs, pukcab.RequiredField(Name, "username"))
+	}
+	if config.Password == "" {
+		errs = append(errs, pukcab.RequiredField(Name, "password"))
+	}
+	return errs.Err()
+}
+
+// Host returns the host that this module connects to
+func (m PFSenseModule) Host(c interface{}) string {
+	config := PFSenseConfig{}
+	if err := pukcab.MarshallConfig(c, &config); err != nil {
+		return ""
+	}
+	return config.HostAddress
+}
@@ -2,6 +2,7 @@ package pfsense
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"fmt"
 	"io"
@@ -9,18 +10,17 @@ import (
 	"net/http"
 	"net/http/cookiejar"
 	"net/url"
-	"os"
 	"regexp"
 
 	"github.com/ecnepsnai/pukcab"
 )
 
-func runBackup(config PFSenseConfig) (*pukcab.File, error) {
+func runBackup(ctx context.Context, instance *pukcab.Instance, config PFSenseConfig) (*pukcab.File, error) {
 	backupURL := "https://" + config.HostAddress + "/diag_backup.php"
 
 	jar, err := cookiejar.New(nil)
 	if err != nil {
-		log.Error("Error making new cookiejar: error='%s'", err.Error())
+		instance.Log.Error("Error making new cookiejar: error='%s'", err.Error())
 		return nil, err
 	}
 	client := &http.Client{
@@ -32,23 +32,24 @@ func runBackup(config PFSenseConfig) (*pukcab.File, error) {
 	}
 	client.Transport = tr
 
-	csrfRequest, err := http.NewRequest("GET", backupURL, nil)
+	csrfRequest, err := http.NewRequestWithContext(ctx, "GET", backupURL, nil)
 	if err != nil {
-		log.Error("Error forming CSRF request: error='%s'", err.Error())
+		instance.Log.Error("Error forming CSRF request: error='%s'", err.Error())
 		return nil, err
 	}
 
 	csrfResponse, err := client.Do(csrfRequest)
 	if err != nil {
-		log.Error("Error making CSRF request: error='%s'", err.Error())
+		instance.Log.Error("Error making CSRF request: error='%s'", err.Error())
 		return nil, err
 	}
+	defer csrfResponse.Body.Close()
 	if csrfResponse.StatusCode != 200 {
-		log.Error("HTTP error making CSRF request: status_code=%d", csrfResponse.StatusCode)
+		instance.Log.Error("HTTP error making CSRF request: status_code=%d", csrfResponse.StatusCode)
 		return nil, fmt.Errorf("http %d", csrfResponse.StatusCode)
 	}
 
-	csrfToken, err := getCSRFTokenFromResponse(csrfResponse)
+	csrfToken, err := getCSRFTokenFromResponse(instance, csrfResponse)
 	if err != nil {
 		return nil, err
 	}
@@ -58,23 +59,24 @@ func runBackup(config PFSenseConfig) (*pukcab.File, error) {
 	loginParams.Add("usernamefld", config.Username)
 	loginParams.Add("passwordfld", config.Password)
 	loginParams.Add("__csrf_magic", csrfToken)
-	loginRequest, err := http.NewRequest("POST", backupURL, bytes.NewReader([]byte(loginParams.Encode())))
+	loginRequest, err := http.NewRequestWithContext(ctx, "POST", backupURL, bytes.NewReader([]byte(loginParams.Encode())))
 	if err != nil {
-		log.Error("Error forming login request: error='%s'", err.Error())
+		instance.Log.Error("Error forming login request: error='%s'", err.Error())
 		return nil, err
 	}
 	loginRequest.Header.Add("Content-Type", "application/x-www-form-urlencoded")
 
 	loginResponse, err := client.Do(loginRequest)
 	if err != nil {
-		log.Error("Error making login request: error='%s'", err.Error())
+		instance.Log.Error("Error making login request: error='%s'", err.Error())
 		return nil, err
 	}
+	defer loginResponse.Body.Close()
 	if loginResponse.StatusCode != 200 {
-		log.Error("HTTP error making login request: status_code=%d", loginResponse.StatusCode)
+		instance.Log.Error("HTTP error making login request: status_code=%d", loginResponse.StatusCode)
 		return nil, fmt.Errorf("http %d", loginResponse.StatusCode)
 	}
-	csrfToken, err = getCSRFTokenFromResponse(loginResponse)
+	csrfToken, err = getCSRFTokenFromResponse(instance, loginResponse)
 	if err != nil {
 		return nil, err
 	}
@@ -87,9 +89,9 @@ func runBackup(config PFSenseConfig) (*pukcab.File, error) {
 		backupParams.Add("encrypt", "yes")
 		backupParams.Add("encrypt_password", config.EncryptPassword)
 	}
-	backupRequest, err := http.NewRequest("POST", backupURL, bytes.NewReader([]byte(backupParams.Encode())))
+	backupRequest, err := http.NewRequestWithContext(ctx, "POST", backupURL, bytes.NewReader([]byte(backupParams.Encode())))
 	if err != nil {
-		log.Error("Error forming backup request: error='%s'", err.Error())
+		instance.Log.Error("Error forming backup request: error='%s'", err.Error())
 		return nil, err
 	}
 	backupRequest.Header.Add("Content-Type", "application/x-www-form-urlencoded")
@@ -97,47 +99,47 @@ func runBackup(config PFSenseConfig) (*pukcab.File, error) {
 
 	backupResponse, err := client.Do(backupRequest)
 	if err != nil {
-		log.Error("Error making backup request: error='%s'", err.Error())
+		instance.Log.Error("Error making backup request: error='%s'", err.Error())
 		return nil, err
 	}
+	defer backupResponse.Body.Close()
 	if backupResponse.StatusCode != 200 {
-		log.Error("HTTP error making backup request: status_code=%d", backupResponse.StatusCode)
+		instance.Log.Error("HTTP error making backup request: status_code=%d", backupResponse.StatusCode)
 		return nil, fmt.Errorf("http %d", backupResponse.StatusCode)
 	}
 
-	filePath := pukcab.GetFilePath(Name, config.HostAddress+".xml")
-	f, err := os.OpenFile(filePath, os.O_CREATE|os.O_WRONLY, 0644)
+	w, err := pukcab.CreateArtifact(instance, config.HostAddress+".xml")
 	if err != nil {
-		log.Error("Error opening destination file: file_path='%s' error='%s'", filePath, err.Error())
 		return nil, err
 	}
-	defer f.Close()
-
-	if _, err := io.Copy(f, backupResponse.Body); err != nil {
-		log.Error("Error writing backup file: file_path='%s' error='%s'", filePath, err.Error())
+	if _, err := io.Copy(w, backupResponse.Body); err != nil {
+		instance.Log.Error("Error writing backup file: file_path='%s' error='%s'", w.Path(), err.Error())
+		w.Abort()
+		return nil, err
+	}
+	file, err := w.Commit()
+	if err != nil {
 		return nil, err
 	}
 
-	return &pukcab.File{
-		Path: filePath,
-	}, nil
+	file.Source = config.HostAddress
+	return file, nil
 }
 
-func getCSRFTokenFromResponse(resp *http.Response) (string, error) {
+func getCSRFTokenFromResponse(instance *pukcab.Instance, resp *http.Response) (string, error) {
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		log.Error("Error reading HTTP body: error='%s'", err.Error())
+		instance.Log.Error("Error reading HTTP body: error='%s'", err.Error())
 		return "", err
 	}
-	resp.Body.Close()
 	csrfTokenPattern := regexp.MustCompile("var csrfMagicToken = \"[a-zA-Z0-9:;,]+\";")
 	csrfTokenRaw := csrfTokenPattern.Find(body)
 	if len(csrfTokenRaw) == 0 {
-		log.Error("No CSRF token found")
+		instance.Log.Error("No CSRF token found")
 		return "", fmt.Errorf("no csrf token found")
 	}
 	token := string(regexp.MustCompile("\".*\"").Find(csrfTokenRaw))
 	token = token[1 : len(token)-1]
-	log.Debug("CSRF token found: %s", token)
+	instance.Log.Debug("CSRF token found: %s", token)
 	return token, nil
 }
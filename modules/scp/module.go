@@ -1,14 +1,12 @@
 package scp
 
 import (
+	"context"
 	"fmt"
 
-	"github.com/ecnepsnai/logtic"
 	"github.com/ecnepsnai/pukcab"
 )
 
-var log = logtic.Log.Connect("pukcab/scp")
-
 const Name = "scp"
 
 type SCPConfig struct {
@@ -28,16 +26,70 @@ func (m SCPModule) Name() string {
 	return Name
 }
 
-func (m SCPModule) Run(c interface{}) ([]pukcab.File, error) {
+func (m SCPModule) RunContext(ctx context.Context, instance *pukcab.Instance, c interface{}) ([]pukcab.File, error) {
 	config := SCPConfig{}
 	if err := pukcab.MarshallConfig(c, &config); err != nil {
-		return nil, fmt.Errorf("invalid config for module")
+		return nil, fmt.Errorf("invalid config for module: %w", err)
 	}
 
-	file, err := runBackup(config)
+	file, err := runBackup(ctx, instance, config)
 	if err != nil {
 		return nil, err
 	}
 
 	return []pukcab.File{*file}, nil
 }
+
+// DryRun checks that scp can be found without connecting to the host
+func (m SCPModule) DryRun(ctx context.Context, instance *pukcab.Instance, c interface{}) ([]pukcab.PlannedArtifact, error) {
+	config := SCPConfig{}
+	if err := pukcab.MarshallConfig(c, &config); err != nil {
+		return nil, fmt.Errorf("invalid config for module: %w", err)
+	}
+
+	if _, err := findScp(config); err != nil {
+		return nil, err
+	}
+
+	return []pukcab.PlannedArtifact{
+		{
+			Path:   pukcab.GetFilePath(instance, artifactName(config)),
+			Source: remotePath(config),
+		},
+	}, nil
+}
+
+// Validate checks the module config for problems
+func (m SCPModule) Validate(c interface{}) error {
+	config := SCPConfig{}
+	if err := pukcab.MarshallConfig(c, &config); err != nil {
+		return fmt.Errorf("%s: %w", Name, err)
+	}
+
+	errs := pukcab.ConfigErrors{}
+	if config.HostAddress == "" {
+		errs = append(errs, pukcab.RequiredField(Name, "host_address"))
+	}
+	if config.Username == "" {
+		errs = append(errs, pukcab.RequiredField(Name, "username"))
+	}
+	if config.PrivateKey == "" {
+		errs = append(errs, pukcab.RequiredField(Name, "private_key"))
+	}
+	if config.HostPublicKey == "" {
+		errs = append(errs, pukcab.RequiredField(Name, "host_public_key"))
+	}
+	if config.FilePath == "" {
+		errs = append(errs, pukcab.RequiredField(Name, "file_path"))
+	}
+	return errs.Err()
+}
+
+// Host returns the host that this module connects to
+func (m SCPModule) Host(c interface{}) string {
+	config := SCPConfig{}
+	if err := pukcab.MarshallConfig(c, &config); err != nil {
+		return ""
+	}
+	return config.HostAddress
+}
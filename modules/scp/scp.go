@@ -1,6 +1,7 @@
 package scp
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"os/exec"
@@ -9,60 +10,61 @@ import (
 	"github.com/ecnepsnai/pukcab"
 )
 
-func runBackup(config SCPConfig) (*pukcab.File, error) {
+func runBackup(ctx context.Context, instance *pukcab.Instance, config SCPConfig) (*pukcab.File, error) {
 	priv, err := os.CreateTemp("", "scp_prk")
 	if err != nil {
-		log.PPanic("Error making temp file", map[string]interface{}{
+		instance.Log.PError("Error making temp file", map[string]interface{}{
 			"error": err.Error(),
 		})
+		return nil, err
 	}
+	privPath := priv.Name()
+	defer func() {
+		priv.Close()
+		os.Remove(privPath)
+	}()
 	if err := priv.Chmod(0600); err != nil {
-		log.PPanic("Error chmod temp file", map[string]interface{}{
+		instance.Log.PError("Error chmod temp file", map[string]interface{}{
 			"error": err.Error(),
 		})
+		return nil, err
 	}
-	privPath := priv.Name()
 	pub, err := os.CreateTemp("", "scp_pbk")
 	if err != nil {
-		log.PPanic("Error making temp file", map[string]interface{}{
-			"error": err.Error(),
-		})
-	}
-	if err := pub.Chmod(0600); err != nil {
-		log.PPanic("Error chmod temp file", map[string]interface{}{
+		instance.Log.PError("Error making temp file", map[string]interface{}{
 			"error": err.Error(),
 		})
+		return nil, err
 	}
 	pubPath := pub.Name()
-
 	defer func() {
-		priv.Close()
 		pub.Close()
-		os.Remove(privPath)
 		os.Remove(pubPath)
 	}()
+	if err := pub.Chmod(0600); err != nil {
+		instance.Log.PError("Error chmod temp file", map[string]interface{}{
+			"error": err.Error(),
+		})
+		return nil, err
+	}
 
 	if _, err := priv.WriteString(config.PrivateKey); err != nil {
-		log.PError("Error writing private key to temporary file", map[string]interface{}{
+		instance.Log.PError("Error writing private key to temporary file", map[string]interface{}{
 			"error": err.Error(),
 		})
 		return nil, err
 	}
 
 	if _, err := pub.WriteString(fmt.Sprintf("%s %s\n", config.HostAddress, config.HostPublicKey)); err != nil {
-		log.PError("Error writing public key to temporary file", map[string]interface{}{
+		instance.Log.PError("Error writing public key to temporary file", map[string]interface{}{
 			"error": err.Error(),
 		})
 		return nil, err
 	}
 
-	scpPath := config.ScpPath
-	if scpPath == "" {
-		p, err := exec.LookPath("scp")
-		if err != nil {
-			return nil, fmt.Errorf("no scp bin found")
-		}
-		scpPath = p
+	scpPath, err := findScp(config)
+	if err != nil {
+		return nil, err
 	}
 
 	port := config.Port
@@ -70,33 +72,59 @@ func runBackup(config SCPConfig) (*pukcab.File, error) {
 		port = 22
 	}
 
-	outputFilePath := pukcab.GetFilePath(Name, fmt.Sprintf("%s_%s", sanitizePath(config.HostAddress), sanitizePath(config.FilePath)))
+	w, err := pukcab.CreateArtifact(instance, artifactName(config))
+	if err != nil {
+		return nil, err
+	}
 
 	args := []string{
 		"-P", fmt.Sprintf("%d", port),
 		"-o", fmt.Sprintf("UserKnownHostsFile=%s", pubPath),
 		"-i", privPath,
-		fmt.Sprintf("%s@%s:%s", config.Username, config.HostAddress, config.FilePath),
-		outputFilePath,
+		remotePath(config),
+		w.TempPath(),
 	}
 
-	log.Debug("exec %s %s", scpPath, args)
-	cmd := exec.Command(scpPath, args...)
+	instance.Log.Debug("exec %s %s", scpPath, pukcab.RedactSecrets(strings.Join(args, " ")))
+	cmd := exec.CommandContext(ctx, scpPath, args...)
 	output, err := cmd.CombinedOutput()
-	log.Debug("scp output: %s", output)
+	instance.Log.Debug("scp output: %s", pukcab.RedactSecrets(string(output)))
+	if err != nil {
+		w.Abort()
+		return nil, err
+	}
+	file, err := w.Commit()
 	if err != nil {
 		return nil, err
 	}
 
-	log.PInfo("SCP success", map[string]interface{}{
-		"host_address": config.HostAddress,
-		"username":     config.Username,
-		"file_path":    config.FilePath,
+	instance.Log.PInfo("SCP success", map[string]interface{}{
+		"host_address": pukcab.RedactSecrets(config.HostAddress),
+		"username":     pukcab.RedactSecrets(config.Username),
+		"file_path":    pukcab.RedactSecrets(config.FilePath),
 	})
 
-	return &pukcab.File{
-		Path: outputFilePath,
-	}, nil
+	file.Source = remotePath(config)
+	return file, nil
+}
+
+func findScp(config SCPConfig) (string, error) {
+	if config.ScpPath != "" {
+		return config.ScpPath, nil
+	}
+	p, err := exec.LookPath("scp")
+	if err != nil {
+		return "", fmt.Errorf("no scp bin found")
+	}
+	return p, nil
+}
+
+func artifactName(config SCPConfig) string {
+	return fmt.Sprintf("%s_%s", sanitizePath(config.HostAddress), sanitizePath(config.FilePath))
+}
+
+func remotePath(config SCPConfig) string {
+	return fmt.Sprintf("%s@%s:%s", config.Username, config.HostAddress, config.FilePath)
 }
 
 func sanitizePath(fileName string) string {
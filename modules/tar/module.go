@@ -1,10 +1,12 @@
 package tar
 
 import (
+	"context"
 	"fmt"
+	"os"
 	"os/exec"
+	"strings"
 
-	"github.com/ecnepsnai/logtic"
 	"github.com/ecnepsnai/pukcab"
 )
 
@@ -14,8 +16,6 @@ type TarConfig struct {
 	Sources     []string `json:"sources"`
 }
 
-var log = logtic.Log.Connect("pukcab/tar")
-
 const Name = "tar"
 
 // TarModule the Tar pukcab module
@@ -25,30 +25,105 @@ func (m TarModule) Name() string {
 	return Name
 }
 
-func (m TarModule) Run(c interface{}) ([]pukcab.File, error) {
+func (m TarModule) RunContext(ctx context.Context, instance *pukcab.Instance, c interface{}) ([]pukcab.File, error) {
 	config := TarConfig{
 		TarPath: "tar",
 	}
 	if err := pukcab.MarshallConfig(c, &config); err != nil {
-		return nil, fmt.Errorf("invalid config for module")
+		return nil, fmt.Errorf("invalid config for module: %w", err)
+	}
+
+	w, err := pukcab.CreateArtifact(instance, tarballName(instance, config))
+	if err != nil {
+		return nil, err
 	}
 
+	// Leave the tarball uncompressed if pukcab will compress it
+	flags := "-czf"
+	if instance.Compression != nil {
+		flags = "-cf"
+	}
 	args := []string{
-		"-czf",
-		pukcab.GetFilePath(Name, config.TarballName),
+		flags,
+		w.TempPath(),
 	}
 	args = append(args, config.Sources...)
-	cmd := exec.Command(config.TarPath, args...)
+	cmd := exec.CommandContext(ctx, config.TarPath, args...)
 	out, err := cmd.CombinedOutput()
-	log.Debug("tar output: %s", out)
+	instance.Log.Debug("tar output: %s", out)
+	if err != nil {
+		instance.Log.Error("Error running tar command: error='%s'", err.Error())
+		w.Abort()
+		return nil, err
+	}
+	file, err := w.Commit()
 	if err != nil {
-		log.Error("Error running tar command: error='%s'", err.Error())
 		return nil, err
 	}
 
-	return []pukcab.File{
+	file.Source = strings.Join(config.Sources, " ")
+	return []pukcab.File{*file}, nil
+}
+
+// DryRun checks that each source exists without creating the tarball
+func (m TarModule) DryRun(ctx context.Context, instance *pukcab.Instance, c interface{}) ([]pukcab.PlannedArtifact, error) {
+	config := TarConfig{
+		TarPath: "tar",
+	}
+	if err := pukcab.MarshallConfig(c, &config); err != nil {
+		return nil, fmt.Errorf("invalid config for module: %w", err)
+	}
+
+	if _, err := exec.LookPath(config.TarPath); err != nil {
+		return nil, fmt.Errorf("no tar bin found")
+	}
+	for _, source := range config.Sources {
+		info, err := os.Stat(source)
+		if err != nil {
+			instance.Log.Error("Error reading tar source: source='%s' error='%s'", source, err.Error())
+			return nil, err
+		}
+		instance.Log.Info("Tar source: source='%s' is_dir=%v", source, info.IsDir())
+	}
+
+	return []pukcab.PlannedArtifact{
 		{
-			Path: pukcab.GetFilePath(Name, config.TarballName),
+			Path:   pukcab.GetFilePath(instance, tarballName(instance, config)),
+			Source: strings.Join(config.Sources, " "),
 		},
 	}, nil
 }
+
+// tarballName returns the name of the tarball. If pukcab will compress the tarball then it is saved uncompressed, so a
+// .tar.gz or .tgz extension is replaced with .tar rather than naming an uncompressed tarball as if it were gzipped.
+func tarballName(instance *pukcab.Instance, config TarConfig) string {
+	if instance.Compression == nil {
+		return config.TarballName
+	}
+	lower := strings.ToLower(config.TarballName)
+	for _, ext := range []string{".tar.gz", ".tgz"} {
+		if strings.HasSuffix(lower, ext) {
+			name := config.TarballName[:len(config.TarballName)-len(ext)] + ".tar"
+			instance.Log.Warn("Tarball is compressed by pukcab, saving it as '%s' instead of '%s'", name, config.TarballName)
+			return name
+		}
+	}
+	return config.TarballName
+}
+
+// Validate checks the module config for problems
+func (m TarModule) Validate(c interface{}) error {
+	config := TarConfig{}
+	if err := pukcab.MarshallConfig(c, &config); err != nil {
+		return fmt.Errorf("%s: %w", Name, err)
+	}
+
+	errs := pukcab.ConfigErrors{}
+	if config.TarballName == "" {
+		errs = append(errs, pukcab.RequiredField(Name, "tarball_name"))
+	}
+	if len(config.Sources) == 0 {
+		errs = append(errs, pukcab.RequiredField(Name, "sources"))
+	}
+	return errs.Err()
+}
@@ -0,0 +1,251 @@
+package pukcab
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sync"
+)
+
+// Processor describes a step that is applied to each artifact after a module saves it, such as compression or
+// encryption. Processors can also implement the Validator interface to check their config before anything is run.
+type Processor interface {
+	Name() string
+	// Process is called with each artifact in turn. It returns the processed artifact, which is passed to the next
+	// processor, followed by any additional artifacts that it saved such as signatures. A processor that saves the
+	// artifact to a new file must remove the original. If an error is returned then the artifact is discarded.
+	Process(ctx context.Context, instance *Instance, artifact Artifact, c interface{}) ([]Artifact, error)
+	// Plan returns the paths that Process would save for an artifact at filePath, in the same order, and is used for
+	// dry runs. Plan must not change anything.
+	Plan(instance *Instance, filePath string, c interface{}) ([]string, error)
+}
+
+// ProcessorType describes a processor configuration for pukcab
+type ProcessorType struct {
+	// The name of the processor, such as "compress"
+	Name   string      `json:"name"`
+	Config interface{} `json:"config"`
+}
+
+var processors = map[string]Processor{}
+var processorsLock = &sync.Mutex{}
+
+func init() {
+	for _, processor := range []Processor{
+		compressProcessor{},
+		encryptProcessor{},
+		checksumProcessor{},
+		signProcessor{},
+		renameProcessor{},
+		uploadProcessor{},
+	} {
+		RegisterProcessor(processor)
+	}
+}
+
+// RegisterProcessor will make the processor available to use in configs, replacing any processor with the same name
+func RegisterProcessor(processor Processor) {
+	processorsLock.Lock()
+	defer processorsLock.Unlock()
+	processors[processor.Name()] = processor
+}
+
+// getProcessor returns the registered processor with the given name
+func getProcessor(name string) (Processor, bool) {
+	processorsLock.Lock()
+	defer processorsLock.Unlock()
+	processor, ok := processors[name]
+	return processor, ok
+}
+
+// processorPipeline returns the processors applied to artifacts of the module instance. The processors of the
+// instance replace the global processors. Compression set with the compression option is added to the start of the
+// pipeline unless it already has a compress step, and encryption set with the encryption option is added before the
+// first upload step, or to the end of the pipeline if there isn't one, unless it already has an encrypt step.
+func processorPipeline(instance ModuleType) []ProcessorType {
+	pipeline := pukcabConfig.Processors
+	if instance.Processors != nil {
+		pipeline = instance.Processors
+	}
+	if compression := compressionConfig(instance); compression != nil && !hasProcessor(pipeline, compressProcessorName) {
+		pipeline = append([]ProcessorType{{Name: compressProcessorName, Config: compression}}, pipeline...)
+	}
+	if encryption := encryptionConfig(instance); encryption != nil && !hasProcessor(pipeline, encryptProcessorName) {
+		// Artifacts must never be uploaded before they are encrypted
+		i := len(pipeline)
+		for j, step := range pipeline {
+			if step.Name == uploadProcessorName {
+				i = j
+				break
+			}
+		}
+		encrypted := append([]ProcessorType{}, pipeline[:i]...)
+		encrypted = append(encrypted, ProcessorType{Name: encryptProcessorName, Config: encryption})
+		pipeline = append(encrypted, pipeline[i:]...)
+	}
+	return pipeline
+}
+
+// hasProcessor returns true if the pipeline has a step with the given processor name
+func hasProcessor(pipeline []ProcessorType, name string) bool {
+	for _, step := range pipeline {
+		if step.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// runProcessors applies each processor in the pipeline to the artifact. Returns the processed artifact followed by
+// any additional artifacts the processors saved. If a processor fails then the artifact and any files saved by earlier
+// processors are removed.
+func runProcessors(ctx context.Context, instance *Instance, pipeline []ProcessorType, artifact Artifact) ([]Artifact, error) {
+	saved := []Artifact{}
+	for _, step := range pipeline {
+		processed, err := runProcessor(ctx, instance, step, artifact)
+		if err != nil {
+			os.Remove(artifact.Path)
+			for _, file := range saved {
+				os.Remove(file.Path)
+			}
+			return nil, fmt.Errorf("%s: %w", step.Name, err)
+		}
+
+		applied := append(append([]string{}, artifact.Processors...), step.Name)
+		artifact = processed[0]
+		artifact.Processors = applied
+		saved = append(saved, processed[1:]...)
+		instance.Log.PDebug("Processed artifact", map[string]interface{}{
+			"processor": step.Name,
+			"file_path": artifact.Path,
+			"size":      artifact.Size,
+		})
+	}
+	return append([]Artifact{artifact}, saved...), nil
+}
+
+func runProcessor(ctx context.Context, instance *Instance, step ProcessorType, artifact Artifact) ([]Artifact, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	processor, ok := getProcessor(step.Name)
+	if !ok {
+		return nil, fmt.Errorf("'%s' is not a known processor", step.Name)
+	}
+	config, err := ResolveSecrets(ctx, step.Config)
+	if err != nil {
+		return nil, err
+	}
+	processed, err := processor.Process(ctx, instance, artifact, config)
+	if err != nil {
+		return nil, redactError(err)
+	}
+	if len(processed) == 0 {
+		return nil, fmt.Errorf("processor did not return the artifact")
+	}
+	return processed, nil
+}
+
+// planProcessors returns the paths that the pipeline would save for an artifact at filePath, starting with the
+// processed artifact
+func planProcessors(instance *Instance, pipeline []ProcessorType, filePath string) ([]string, error) {
+	saved := []string{}
+	for _, step := range pipeline {
+		processor, ok := getProcessor(step.Name)
+		if !ok {
+			return nil, fmt.Errorf("'%s' is not a known processor", step.Name)
+		}
+		planned, err := processor.Plan(instance, filePath, step.Config)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", step.Name, err)
+		}
+		if len(planned) == 0 {
+			return nil, fmt.Errorf("%s: processor did not return the artifact", step.Name)
+		}
+		filePath = planned[0]
+		saved = append(saved, planned[1:]...)
+	}
+	return append([]string{filePath}, saved...), nil
+}
+
+// validateProcessors checks the processors of a pipeline for problems. destinationLabels are the labels of every
+// destination in the config, which upload steps must refer to.
+func validateProcessors(label string, pipeline []ProcessorType, destinationLabels map[string]bool) ConfigErrors {
+	errs := ConfigErrors{}
+	uploadStep := -1
+	for i, step := range pipeline {
+		stepLabel := fmt.Sprintf("%s.processors[%d]", label, i)
+		if step.Name == uploadProcessorName && uploadStep < 0 {
+			uploadStep = i
+		}
+		if step.Name == encryptProcessorName && uploadStep >= 0 {
+			config := EncryptionConfig{}
+			if err := MarshallConfig(step.Config, &config); err == nil && config.Method != EncryptionNone {
+				errs = append(errs, FieldError{stepLabel, "name", fmt.Sprintf("must come before the upload step at processors[%d] so that artifacts are never uploaded in cleartext", uploadStep)})
+			}
+		}
+		processor, ok := getProcessor(step.Name)
+		if !ok {
+			errs = append(errs, FieldError{stepLabel, "name", fmt.Sprintf("'%s' is not a known processor", step.Name)})
+			continue
+		}
+		errs = append(errs, validateSecretReferences(stepLabel+".config", step.Config)...)
+
+		if step.Name == uploadProcessorName {
+			config := UploadProcessorConfig{}
+			if err := MarshallConfig(step.Config, &config); err == nil && config.Destination != "" && !destinationLabels[config.Destination] {
+				errs = append(errs, FieldError{stepLabel, "destination", fmt.Sprintf("'%s' is not a configured destination", config.Destination)})
+			}
+		}
+
+		validator, ok := processor.(Validator)
+		if !ok {
+			continue
+		}
+		if err := validator.Validate(step.Config); err != nil {
+			if processorErrs, ok := err.(ConfigErrors); ok {
+				for _, processorErr := range processorErrs {
+					errs = append(errs, fmt.Errorf("%s: %w", stepLabel, processorErr))
+				}
+			} else {
+				errs = append(errs, fmt.Errorf("%s: %w", stepLabel, err))
+			}
+		}
+	}
+	return errs
+}
+
+// writeProcessedFile will save the data written by write to filePath, using a temporary file that is only renamed
+// into place once it is complete. Returns the size and SHA-256 checksum of the file.
+func writeProcessedFile(filePath string, write func(w io.Writer) error) (uint64, string, error) {
+	f, err := os.CreateTemp(path.Dir(filePath), TempPattern(filePath))
+	if err != nil {
+		return 0, "", err
+	}
+	tmpPath := f.Name()
+
+	h := sha256.New()
+	counter := &countingWriter{}
+	err = write(io.MultiWriter(f, h, counter))
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmpPath, 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, filePath)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return 0, "", err
+	}
+	return counter.n, hex.EncodeToString(h.Sum(nil)), nil
+}
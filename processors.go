@@ -0,0 +1,283 @@
+package pukcab
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Names of the built-in processors
+const (
+	compressProcessorName = "compress"
+	encryptProcessorName  = "encrypt"
+	checksumProcessorName = "checksum"
+	signProcessorName     = "sign"
+	renameProcessorName   = "rename"
+	uploadProcessorName   = "upload"
+)
+
+// checksumProcessor saves the SHA-256 checksum of each artifact next to it, in the format used by sha256sum
+type checksumProcessor struct{}
+
+func (p checksumProcessor) Name() string {
+	return checksumProcessorName
+}
+
+func (p checksumProcessor) Process(ctx context.Context, instance *Instance, artifact Artifact, c interface{}) ([]Artifact, error) {
+	checksumPath := artifact.Path + ".sha256"
+	size, checksum, err := writeProcessedFile(checksumPath, func(w io.Writer) error {
+		_, err := fmt.Fprintf(w, "%s  %s\n", artifact.SHA256, path.Base(artifact.Path))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return []Artifact{artifact, {Path: checksumPath, Size: size, SHA256: checksum}}, nil
+}
+
+func (p checksumProcessor) Plan(instance *Instance, filePath string, c interface{}) ([]string, error) {
+	return []string{filePath, filePath + ".sha256"}, nil
+}
+
+// SignProcessorConfig describes the config for the sign processor
+type SignProcessorConfig struct {
+	// The key ID, fingerprint, or email address of the secret key in the gpg keyring to sign with
+	Key string `json:"key"`
+	// If true the signature is ASCII armored and saved with a .asc extension instead of .sig
+	Armor bool `json:"armor"`
+	// Optional path of the gpg binary, if omitted gpg is searched for in $PATH
+	GPGPath string `json:"gpg_path"`
+	// Optional gpg home directory containing the keyring
+	GPGHome string `json:"gpg_home"`
+}
+
+// signProcessor saves a detached OpenPGP signature of each artifact next to it
+type signProcessor struct{}
+
+func (p signProcessor) Name() string {
+	return signProcessorName
+}
+
+func (p signProcessor) Process(ctx context.Context, instance *Instance, artifact Artifact, c interface{}) ([]Artifact, error) {
+	config := SignProcessorConfig{}
+	if err := MarshallConfig(c, &config); err != nil {
+		return nil, fmt.Errorf("invalid config for processor: %w", err)
+	}
+
+	signaturePath := signaturePath(artifact.Path, config)
+	args := []string{"--batch", "--yes", "--local-user", config.Key, "--output", "-"}
+	if config.Armor {
+		args = append(args, "--armor")
+	}
+	args = append(args, "--detach-sign", artifact.Path)
+	size, checksum, err := writeProcessedFile(signaturePath, func(w io.Writer) error {
+		return runGPG(ctx, config.GPGPath, config.GPGHome, args, w)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return []Artifact{artifact, {Path: signaturePath, Size: size, SHA256: checksum}}, nil
+}
+
+func (p signProcessor) Plan(instance *Instance, filePath string, c interface{}) ([]string, error) {
+	config := SignProcessorConfig{}
+	if err := MarshallConfig(c, &config); err != nil {
+		return nil, fmt.Errorf("invalid config for processor: %w", err)
+	}
+	return []string{filePath, signaturePath(filePath, config)}, nil
+}
+
+// Validate checks the processor config for problems
+func (p signProcessor) Validate(c interface{}) error {
+	config := SignProcessorConfig{}
+	if err := MarshallConfig(c, &config); err != nil {
+		return fmt.Errorf("%s: %w", signProcessorName, err)
+	}
+	if config.Key == "" {
+		return RequiredField(signProcessorName, "key")
+	}
+	return nil
+}
+
+func signaturePath(filePath string, config SignProcessorConfig) string {
+	if config.Armor {
+		return filePath + ".asc"
+	}
+	return filePath + ".sig"
+}
+
+// RenameProcessorConfig describes the config for the rename processor
+type RenameProcessorConfig struct {
+	// The new file name of the artifact, where {name} is replaced with the current file name. See renameVariables for
+	// the other placeholders.
+	Template string `json:"template"`
+}
+
+// renamePattern matches a {name} placeholder in a rename template
+var renamePattern = regexp.MustCompile(`\{([a-z_]*)\}`)
+
+// renameProcessor renames each artifact using a template
+type renameProcessor struct{}
+
+func (p renameProcessor) Name() string {
+	return renameProcessorName
+}
+
+func (p renameProcessor) Process(ctx context.Context, instance *Instance, artifact Artifact, c interface{}) ([]Artifact, error) {
+	newPath, err := p.renamedPath(instance, artifact.Path, c)
+	if err != nil {
+		return nil, err
+	}
+	if newPath == artifact.Path {
+		return []Artifact{artifact}, nil
+	}
+	if err := os.Rename(artifact.Path, newPath); err != nil {
+		return nil, err
+	}
+	artifact.Path = newPath
+	return []Artifact{artifact}, nil
+}
+
+func (p renameProcessor) Plan(instance *Instance, filePath string, c interface{}) ([]string, error) {
+	newPath, err := p.renamedPath(instance, filePath, c)
+	if err != nil {
+		return nil, err
+	}
+	return []string{newPath}, nil
+}
+
+// Validate checks the processor config for problems
+func (p renameProcessor) Validate(c interface{}) error {
+	config := RenameProcessorConfig{}
+	if err := MarshallConfig(c, &config); err != nil {
+		return fmt.Errorf("%s: %w", renameProcessorName, err)
+	}
+	if config.Template == "" {
+		return RequiredField(renameProcessorName, "template")
+	}
+	if strings.Contains(config.Template, "/") {
+		return FieldError{renameProcessorName, "template", "must be a file name, not a path"}
+	}
+	for _, match := range renamePattern.FindAllStringSubmatch(config.Template, -1) {
+		if _, ok := renameVariables(&Instance{}, "")[match[1]]; !ok {
+			return FieldError{renameProcessorName, "template", fmt.Sprintf("'{%s}' is not a known placeholder", match[1])}
+		}
+	}
+	return nil
+}
+
+// renamedPath returns the new path for the artifact at filePath, which is always in the same directory
+func (p renameProcessor) renamedPath(instance *Instance, filePath string, c interface{}) (string, error) {
+	config := RenameProcessorConfig{}
+	if err := MarshallConfig(c, &config); err != nil {
+		return "", fmt.Errorf("invalid config for processor: %w", err)
+	}
+
+	vars := renameVariables(instance, filePath)
+	var err error
+	name := renamePattern.ReplaceAllStringFunc(config.Template, func(match string) string {
+		value, ok := vars[match[1:len(match)-1]]
+		if !ok && err == nil {
+			err = fmt.Errorf("'%s' is not a known placeholder", match)
+		}
+		return value
+	})
+	if err != nil {
+		return "", err
+	}
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return "", fmt.Errorf("'%s' is not a valid file name", name)
+	}
+	return path.Join(path.Dir(filePath), name), nil
+}
+
+// renameVariables returns the values of the placeholders that can be used in a rename template for the artifact at
+// filePath
+func renameVariables(instance *Instance, filePath string) map[string]string {
+	name := path.Base(filePath)
+	ext := path.Ext(name)
+	return map[string]string{
+		"name":     name,
+		"base":     strings.TrimSuffix(name, ext),
+		"ext":      ext,
+		"module":   instance.Module,
+		"instance": instance.Label,
+		"date":     runStart.Format("2006-01-02"),
+		"time":     runStart.Format("150405"),
+		"run_id":   runID,
+	}
+}
+
+// UploadProcessorConfig describes the config for the upload processor
+type UploadProcessorConfig struct {
+	// The id of the destination to upload to
+	Destination string `json:"destination"`
+}
+
+// uploadProcessor copies each artifact to a destination as soon as it reaches this step of the pipeline, rather than
+// after the module finishes
+type uploadProcessor struct{}
+
+func (p uploadProcessor) Name() string {
+	return uploadProcessorName
+}
+
+func (p uploadProcessor) Process(ctx context.Context, instance *Instance, artifact Artifact, c interface{}) ([]Artifact, error) {
+	config := UploadProcessorConfig{}
+	if err := MarshallConfig(c, &config); err != nil {
+		return nil, fmt.Errorf("invalid config for processor: %w", err)
+	}
+	key, err := destinationKey(artifact.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	err = fmt.Errorf("destination %s is not open", config.Destination)
+	for _, destination := range instance.destinations {
+		if destination.Label != config.Destination {
+			continue
+		}
+		err = putFile(ctx, destination, key, artifact.Path)
+		if err == nil {
+			instance.Log.PInfo("Uploaded artifact", map[string]interface{}{
+				"destination": destination.Label,
+				"key":         key,
+			})
+			instance.uploaded[destination.Label] = append(instance.uploaded[destination.Label], key)
+			return []Artifact{artifact}, nil
+		}
+		err = fmt.Errorf("destination %s: %s: %w", destination.Label, key, redactError(err))
+		break
+	}
+
+	// The artifact is still kept locally, the failure is reported as an error with the destination
+	instance.Log.PError("Error uploading artifact", map[string]interface{}{
+		"destination": config.Destination,
+		"key":         key,
+		"error":       err.Error(),
+	})
+	if instance.uploadErrors[config.Destination] == nil {
+		instance.uploadErrors[config.Destination] = err
+	}
+	return []Artifact{artifact}, nil
+}
+
+func (p uploadProcessor) Plan(instance *Instance, filePath string, c interface{}) ([]string, error) {
+	return []string{filePath}, nil
+}
+
+// Validate checks the processor config for problems
+func (p uploadProcessor) Validate(c interface{}) error {
+	config := UploadProcessorConfig{}
+	if err := MarshallConfig(c, &config); err != nil {
+		return fmt.Errorf("%s: %w", uploadProcessorName, err)
+	}
+	if config.Destination == "" {
+		return RequiredField(uploadProcessorName, "destination")
+	}
+	return nil
+}
@@ -2,10 +2,16 @@
 package pukcab
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"os"
 	"path"
-	"regexp"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/ecnepsnai/logtic"
@@ -14,115 +20,480 @@ import (
 var log = logtic.Log.Connect("pukcab")
 
 var pukcabConfig *Config
+var configureLock = &sync.Mutex{}
+
+var runStart time.Time
+var runID string
+
+// Configure will prepare pukcab for running with the given config instance, creating the output directory if needed
+// unless this is a dry run.
+// Configure must be called once, before any modules are run.
+func Configure(config Config) error {
+	configureLock.Lock()
+	defer configureLock.Unlock()
 
-// Configure will prepare pukcab for running with the given config instance
-func Configure(config Config) {
 	if pukcabConfig != nil {
-		panic("pukcab already configred")
+		return fmt.Errorf("pukcab is already configured")
+	}
+	if !config.DryRun {
+		if err := makeDirectoryIfNotExists(config.OutputDir); err != nil {
+			return fmt.Errorf("output directory: %w", err)
+		}
 	}
 
 	pukcabConfig = &config
-	makeDirectoryIfNotExists(config.OutputDir)
+	runStart = time.Now()
+	runID = newRunID(runStart)
+	return nil
+}
+
+// RunID returns the unique ID of this run of pukcab
+func RunID() string {
+	return runID
+}
+
+// newRunID returns a new run ID that sorts chronologically with other runs on the same day
+func newRunID(start time.Time) string {
+	r := make([]byte, 3)
+	rand.Read(r)
+	return start.Format("150405") + "-" + hex.EncodeToString(r)
+}
+
+// runDirName returns the name of the directory for artifacts saved during this run
+func runDirName() string {
+	switch pukcabConfig.RunLayout {
+	case RunLayoutDateTime:
+		return runStart.Format("2006-01-02_150405")
+	case RunLayoutRunID:
+		return runStart.Format("2006-01-02") + "_" + runID
+	}
+	return runStart.Format("2006-01-02")
 }
 
-// Module describes the interface for a pukcab module
+// Module describes the interface for a pukcab module that does not support cancellation.
+// Modules should implement ContextModule instead, use LegacyModule to run a Module.
 type Module interface {
 	Name() string
-	Run(c interface{}) ([]File, error)
+	Run(instance *Instance, c interface{}) ([]File, error)
+}
+
+// ContextModule describes the interface for a pukcab module. Modules must stop and return when the context is
+// cancelled, any artifacts that were created but not committed are discarded.
+type ContextModule interface {
+	Name() string
+	RunContext(ctx context.Context, instance *Instance, c interface{}) ([]File, error)
+}
+
+// LegacyModule returns a ContextModule for a module that does not support cancellation. If the context is cancelled
+// before the module finishes then the module is left to finish in the background and its artifacts are discarded.
+func LegacyModule(module Module) ContextModule {
+	return legacyModule{module}
+}
+
+type legacyModule struct {
+	module Module
+}
+
+func (m legacyModule) Name() string {
+	return m.module.Name()
+}
+
+func (m legacyModule) Validate(c interface{}) error {
+	if validator, ok := m.module.(Validator); ok {
+		return validator.Validate(c)
+	}
+	return nil
+}
+
+func (m legacyModule) RunContext(ctx context.Context, instance *Instance, c interface{}) ([]File, error) {
+	type runReturn struct {
+		files []File
+		err   error
+	}
+	done := make(chan runReturn, 1)
+	go func() {
+		files, err := m.module.Run(instance, c)
+		done <- runReturn{files, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.files, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Instance describes the module instance that is being run
+type Instance struct {
+	// The name of the module
+	Module string
+	// The label of the module instance
+	Label string
+	// The directory where artifacts for this run are saved
+	Dir string
+	// Log source for this module instance
+	Log *logtic.Source
+	// How artifacts are compressed after the module saves them, or nil if they aren't. Modules that would otherwise
+	// compress their own output should save it uncompressed when this is set.
+	Compression *CompressionConfig
+
+	writers    []*ArtifactWriter
+	writerLock sync.Mutex
+	finished   bool
+	// The destinations that upload processors can use
+	destinations []OpenDestination
+	// The keys uploaded by upload processors, keyed by destination label
+	uploaded map[string][]string
+	// The first error from upload processors, keyed by destination label
+	uploadErrors map[string]error
+}
+
+func (i *Instance) trackWriter(w *ArtifactWriter) error {
+	i.writerLock.Lock()
+	defer i.writerLock.Unlock()
+	if i.finished {
+		w.Abort()
+		return fmt.Errorf("module instance %s has already finished", i.Label)
+	}
+	i.writers = append(i.writers, w)
+	return nil
+}
+
+// abortWriters will abort any artifacts that were created but not committed by the module
+func (i *Instance) abortWriters() {
+	i.writerLock.Lock()
+	defer i.writerLock.Unlock()
+	i.finished = true
+	for _, w := range i.writers {
+		if err := w.Abort(); err == nil {
+			log.PWarn("Discarded uncommitted artifact", map[string]interface{}{
+				"instance":  i.Label,
+				"file_path": w.Path(),
+			})
+		}
+	}
+	i.writers = nil
 }
 
 // File describes a backed-up file
 type File struct {
 	Path string
+	// Optional description of where this file came from, such as a URL or host name
+	Source string
+	// The size and SHA-256 checksum of the file, if known. Set automatically by ArtifactWriter.
+	Size   uint64
+	SHA256 string
+}
+
+// RunModule will run the given backup module for the module instance and return the result of the run.
+// The module is stopped if the context is cancelled or if the instance's timeout is reached.
+func RunModule(ctx context.Context, module ContextModule, instance ModuleType) *RunResult {
+	return runModule(ctx, module, instance, nil)
 }
 
-// RunModule will run the given backup module
-func RunModule(module Module, config interface{}) error {
+// runModule runs the module. destinations are the destinations that upload processors can use.
+func runModule(ctx context.Context, module ContextModule, instance ModuleType, destinations []OpenDestination) *RunResult {
 	name := module.Name()
+	result := &RunResult{
+		ModuleName: name,
+		Instance:   instance.Label(),
+		Start:      time.Now(),
+		DryRun:     IsDryRun(),
+	}
 	log.PInfo("Starting module", map[string]interface{}{
 		"module_name": name,
+		"instance":    result.Instance,
+		"dry_run":     result.DryRun,
 	})
-	start := time.Now()
-	makeDirectoryIfNotExists(path.Join(pukcabConfig.OutputDir, name, time.Now().Format("2006-01-02")))
-	files, err := module.Run(config)
+	if err := ctx.Err(); err != nil {
+		result.Error = fmt.Errorf("module %s: %w", result.Instance, err)
+		result.End = time.Now()
+		return result
+	}
+	outputDir, err := instanceOutputDir(module, instance)
+	if err != nil {
+		result.Error = fmt.Errorf("module %s: %w", result.Instance, err)
+		result.End = time.Now()
+		return result
+	}
+	timeout, err := moduleTimeout(instance)
 	if err != nil {
+		result.Error = fmt.Errorf("module %s: %w", result.Instance, err)
+		result.End = time.Now()
+		return result
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	result.Dir = path.Join(outputDir, runDirName())
+	if !result.DryRun {
+		if err := makeDirectoryIfNotExists(result.Dir); err != nil {
+			result.Error = fmt.Errorf("module %s: %w", result.Instance, err)
+			result.End = time.Now()
+			return result
+		}
+	}
+	pipeline := processorPipeline(instance)
+	runInstance := &Instance{
+		Module:      name,
+		Label:       result.Instance,
+		Dir:         result.Dir,
+		Log:         logtic.Log.Connect(fmt.Sprintf("pukcab/%s[%s]", name, result.Instance)),
+		Compression: pipelineCompression(pipeline),
+
+		destinations: destinations,
+		uploaded:     map[string][]string{},
+		uploadErrors: map[string]error{},
+	}
+	moduleConfig, err := ResolveSecrets(ctx, instance.Config)
+	if err != nil {
+		log.PError("Error resolving secrets for module", map[string]interface{}{
+			"module_name": name,
+			"instance":    result.Instance,
+			"error":       err.Error(),
+		})
+		result.Error = fmt.Errorf("module %s: %w", result.Instance, err)
+		result.End = time.Now()
+		return result
+	}
+	if result.DryRun {
+		return dryRunResult(ctx, module, runInstance, moduleConfig, pipeline, result)
+	}
+	files, err := module.RunContext(ctx, runInstance, moduleConfig)
+	runInstance.abortWriters()
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		// Report the cancellation rather than whatever error the module saw as a result of it
+		if err != nil {
+			err = fmt.Errorf("%w (%s)", ctxErr, err.Error())
+		} else {
+			err = ctxErr
+		}
+	}
+	if err != nil {
+		err = redactError(err)
 		log.PError("Error running module", map[string]interface{}{
 			"module_name": name,
+			"instance":    result.Instance,
 			"error":       err.Error(),
 		})
+		result.Error = fmt.Errorf("module %s: %w", result.Instance, err)
+	}
+
+	changes := changeDetectionConfig(instance)
+	var previous map[string]previousArtifact
+	if changes != nil {
+		previous, err = previousArtifacts(module, instance)
+		if err != nil {
+			log.PWarn("Unable to read previous runs, artifacts will not be compared", map[string]interface{}{
+				"module_name": name,
+				"instance":    result.Instance,
+				"error":       err.Error(),
+			})
+		}
 	}
-	nFiles := 0
 	for _, file := range files {
+		file.Source = RedactSecrets(file.Source)
 		info, err := os.Stat(file.Path)
 		if err != nil {
 			log.PError("Unable to stat module artifact", map[string]interface{}{
 				"module_name": name,
+				"instance":    result.Instance,
 				"file_path":   file.Path,
 				"error":       err.Error(),
 			})
 			os.Remove(file.Path)
+			result.Discarded = append(result.Discarded, DiscardedArtifact{
+				Path:   file.Path,
+				Reason: "unable to stat artifact: " + err.Error(),
+			})
 			continue
 		}
 		if info.Size() == 0 {
 			log.PError("Module produced empty artifact", map[string]interface{}{
 				"module_name": name,
+				"instance":    result.Instance,
+				"file_path":   file.Path,
+			})
+			os.Remove(file.Path)
+			result.Discarded = append(result.Discarded, DiscardedArtifact{
+				Path:   file.Path,
+				Reason: "empty artifact",
+			})
+			continue
+		}
+		checksum := file.SHA256
+		if checksum == "" || file.Size != uint64(info.Size()) {
+			checksum, err = hashFile(file.Path)
+		}
+		if err != nil {
+			log.PError("Unable to read module artifact", map[string]interface{}{
+				"module_name": name,
+				"instance":    result.Instance,
 				"file_path":   file.Path,
+				"error":       err.Error(),
 			})
 			os.Remove(file.Path)
+			result.Discarded = append(result.Discarded, DiscardedArtifact{
+				Path:   file.Path,
+				Reason: "unable to read artifact: " + err.Error(),
+			})
 			continue
 		}
 
-		log.PInfo("Backup artifact saved", map[string]interface{}{
-			"module_name": name,
-			"file_path":   file.Path,
-			"size":        logtic.FormatBytesB(uint64(info.Size())),
+		artifacts, err := runProcessors(ctx, runInstance, pipeline, Artifact{
+			Path:   file.Path,
+			Size:   uint64(info.Size()),
+			SHA256: checksum,
+			Source: file.Source,
 		})
-		nFiles++
+		if err != nil {
+			// The artifact is removed rather than kept unprocessed, so that an artifact is never kept in cleartext
+			// when it should have been encrypted
+			log.PError("Unable to process module artifact", map[string]interface{}{
+				"module_name": name,
+				"instance":    result.Instance,
+				"file_path":   file.Path,
+				"error":       err.Error(),
+			})
+			result.Discarded = append(result.Discarded, DiscardedArtifact{
+				Path:   file.Path,
+				Reason: "unable to process artifact: " + err.Error(),
+			})
+			continue
+		}
+		// Artifacts are only compared if the instance has run before
+		if previous != nil {
+			processed := artifacts[0]
+			artifacts = detectChange(ctx, *changes, runInstance, previous, artifacts)
+			if artifacts == nil {
+				result.Skipped = append(result.Skipped, processed)
+				continue
+			}
+		}
+
+		for _, artifact := range artifacts {
+			if pukcabConfig.Deduplicate {
+				deduplicated, err := deduplicateArtifact(artifact)
+				if err != nil {
+					// The artifact is still kept, it just takes up more space
+					log.PWarn("Unable to deduplicate module artifact", map[string]interface{}{
+						"module_name": name,
+						"instance":    result.Instance,
+						"file_path":   artifact.Path,
+						"error":       err.Error(),
+					})
+				} else if deduplicated {
+					log.PInfo("Backup artifact deduplicated", map[string]interface{}{
+						"module_name": name,
+						"instance":    result.Instance,
+						"file_path":   artifact.Path,
+						"sha256":      artifact.SHA256,
+					})
+				}
+			}
+			log.PInfo("Backup artifact saved", map[string]interface{}{
+				"module_name": name,
+				"instance":    result.Instance,
+				"file_path":   artifact.Path,
+				"size":        logtic.FormatBytesB(artifact.Size),
+				"sha256":      artifact.SHA256,
+				"encrypted":   artifact.Encryption != nil,
+			})
+			result.Artifacts = append(result.Artifacts, artifact)
+		}
+	}
+	result.uploaded = runInstance.uploaded
+	result.uploadErrors = runInstance.uploadErrors
+	result.End = time.Now()
+	if err := appendManifest(result.Dir, manifestRunFromResult(result, instance.Config)); err != nil && result.Error == nil {
+		result.Error = fmt.Errorf("module %s: error writing manifest: %w", result.Instance, err)
 	}
 	log.PInfo("Module finished", map[string]interface{}{
 		"module_name": name,
-		"n_files":     nFiles,
-		"duration":    time.Since(start).String(),
+		"instance":    result.Instance,
+		"n_files":     len(result.Artifacts),
+		"n_discarded": len(result.Discarded),
+		"duration":    result.Duration().String(),
 	})
-	return nil
+	return result
+}
+
+// CleanupModule remove expired artifacts according to the retention policy of the module instance. Returns the paths
+// of the run directories that were removed, or that would have been removed if this is a dry run.
+func CleanupModule(module ContextModule, instance ModuleType) ([]string, error) {
+	return cleanupModule(module, instance, false)
 }
 
-// CleanupModule remove expired artifacts
-func CleanupModule(module Module) error {
-	if pukcabConfig.ArtifactRetention <= 0 {
-		return nil
+// cleanupModule removes expired artifacts. If planRun is true then the directory for the current run is treated as
+// existing, so that a dry run reports the same deletions as a real run would.
+func cleanupModule(module ContextModule, instance ModuleType, planRun bool) ([]string, error) {
+	policy := retentionPolicy(instance)
+	if policy.IsEmpty() {
+		return nil, nil
 	}
 
 	name := module.Name()
+	dryRun := IsDryRun()
 	log.PInfo("Starting module cleanup", map[string]interface{}{
 		"module_name": name,
+		"instance":    instance.Label(),
+		"retention":   policy.String(),
+		"dry_run":     dryRun,
 	})
 	start := time.Now()
 
-	moduleOutputPath := path.Join(pukcabConfig.OutputDir, name)
+	moduleOutputPath, err := instanceOutputDir(module, instance)
+	if err != nil {
+		return nil, err
+	}
 	items, err := os.ReadDir(moduleOutputPath)
 	if err != nil {
+		if os.IsNotExist(err) {
+			// The module has never saved anything
+			return nil, nil
+		}
 		log.PError("Error reading directory", map[string]interface{}{
 			"module_name": name,
 			"directory":   moduleOutputPath,
 		})
-		return err
+		return nil, err
 	}
 
-	retentionHours := float64(pukcabConfig.ArtifactRetention) * 24.0
-	datePattern := regexp.MustCompile("[0-9]{4}-[0-9]{2}-[0-9]{2}")
-
+	removed := []string{}
+	runDirs := []string{}
+	hasCurrentRun := false
 	for _, item := range items {
 		if !item.IsDir() {
 			continue
 		}
 		itemPath := path.Join(moduleOutputPath, item.Name())
+		if item.Name() == runDirName() {
+			// Other modules may still be saving artifacts to the directory for the current run
+			runDirs = append(runDirs, item.Name())
+			hasCurrentRun = true
+			continue
+		}
 
 		subItems, _ := os.ReadDir(itemPath)
+		nEmpty := 0
 		for _, subItem := range subItems {
-			info, _ := subItem.Info()
+			info, err := subItem.Info()
+			if err != nil {
+				continue
+			}
 			subItemPath := path.Join(itemPath, subItem.Name())
 			if info.Size() == 0 {
+				nEmpty++
+				if dryRun {
+					log.PWarn("Would remove empty artifact", map[string]interface{}{
+						"module": name,
+						"path":   subItemPath,
+					})
+					continue
+				}
 				log.PWarn("Removing empty artifact", map[string]interface{}{
 					"module": name,
 					"path":   subItemPath,
@@ -130,71 +501,172 @@ func CleanupModule(module Module) error {
 				os.Remove(subItemPath)
 			}
 		}
-		subItems, _ = os.ReadDir(itemPath)
-		if len(subItems) == 0 {
+		if len(subItems) == nEmpty {
 			log.PWarn("Empty artifact directory", map[string]interface{}{
 				"module": name,
 				"path":   itemPath,
 			})
+			removed = append(removed, itemPath)
+			if dryRun {
+				continue
+			}
 			if err := os.RemoveAll(itemPath); err != nil {
 				log.Error("Error removing expired artifact: module='%s' path='%s' error='%s'", name, itemPath, err.Error())
 			}
 			continue
 		}
 
-		dateStr := datePattern.FindString(item.Name())
-		if dateStr == "" {
-			continue
-		}
-		date, err := time.Parse("2006-01-02", dateStr)
+		runDirs = append(runDirs, item.Name())
+	}
+	if planRun && !hasCurrentRun {
+		runDirs = append(runDirs, runDirName())
+	}
+
+	expired := map[string]bool{}
+	hasArtifacts := func(runDir string) bool {
+		return runDirHasArtifacts(path.Join(moduleOutputPath, runDir))
+	}
+	for _, runDir := range policy.Expired(runDirs, hasArtifacts) {
+		expired[runDir] = true
+	}
+	// When unchanged artifacts are discarded the only copy of an artifact may be in an old run directory
+	if changes := changeDetectionConfig(instance); changes != nil && changes.Unchanged == UnchangedDiscard {
+		previous, err := previousArtifacts(module, instance)
 		if err != nil {
-			continue
+			return nil, err
+		}
+		for _, prev := range previous {
+			runDir := path.Base(prev.Dir)
+			if expired[runDir] {
+				log.PInfo("Keeping expired run directory with the latest copy of an artifact", map[string]interface{}{
+					"module_name": name,
+					"instance":    instance.Label(),
+					"run_dir":     prev.Dir,
+					"file_name":   prev.File.Name,
+				})
+				delete(expired, runDir)
+			}
 		}
-		if time.Since(date).Hours() <= retentionHours {
+	}
+	// Checksums of the removed artifacts, which may no longer need to be kept in the store
+	removedChecksums := []string{}
+	for _, runDir := range runDirs {
+		itemPath := path.Join(moduleOutputPath, runDir)
+		if !expired[runDir] {
 			log.Debug("Artifact not expired: module='%s' path='%s'", name, itemPath)
 			continue
 		}
+		removed = append(removed, itemPath)
+		if dryRun {
+			log.Warn("Artifact would expire: module='%s' path='%s'", name, itemPath)
+			continue
+		}
 		log.Warn("Artifact expired: module='%s' path='%s'", name, itemPath)
+		checksums := manifestChecksums(itemPath)
 		if err := os.RemoveAll(itemPath); err != nil {
 			log.Error("Error removing expired artifact: module='%s' path='%s' error='%s'", name, itemPath, err.Error())
+			continue
 		}
+		removedChecksums = append(removedChecksums, checksums...)
 	}
+	cleanupStore(removedChecksums)
 
 	log.Info("Module cleanup finished: module_name='%s' duration_s=%f", name, time.Since(start).Seconds())
-	return nil
+	return removed, nil
+}
+
+// runDirHasArtifacts returns true if the run directory holds any artifacts. Run directories from before manifests were
+// written have artifacts if they have any non-empty file.
+func runDirHasArtifacts(runDir string) bool {
+	manifest, err := ReadManifest(runDir)
+	if err == nil {
+		for _, run := range manifest.Runs {
+			if len(run.Files) > 0 {
+				return true
+			}
+		}
+		return false
+	}
+	if !os.IsNotExist(err) {
+		// Keep counting a run directory with an unreadable manifest rather than risk expiring newer runs
+		return true
+	}
+	items, _ := os.ReadDir(runDir)
+	for _, item := range items {
+		info, err := item.Info()
+		if err == nil && (item.IsDir() || info.Size() > 0) && !strings.HasSuffix(item.Name(), ".tmp") {
+			return true
+		}
+	}
+	return false
 }
 
 // GetFilePath return an absolute path for a backup artifact.
-// Must specify the module name, a description (which needs to be a filename-safe string), and an extension (without a dot)
-func GetFilePath(moduleName, fileName string) string {
-	return path.Join(pukcabConfig.OutputDir, moduleName, time.Now().Format("2006-01-02"), fileName)
+// Must specify the module instance being run and a file name (which needs to be a filename-safe string)
+func GetFilePath(instance *Instance, fileName string) string {
+	return path.Join(instance.Dir, fileName)
+}
+
+// moduleTimeout returns the maximum duration that the given module instance may run for, or 0 for no limit
+func moduleTimeout(instance ModuleType) (time.Duration, error) {
+	timeout := pukcabConfig.Timeout
+	if instance.Timeout != "" {
+		timeout = instance.Timeout
+	}
+	if timeout == "" {
+		return 0, nil
+	}
+	return parseTimeout(timeout)
 }
 
+// instanceOutputDir returns the directory where all runs of the given module instance are saved
+func instanceOutputDir(module ContextModule, instance ModuleType) (string, error) {
+	if instance.OutputSubdir == "" {
+		return path.Join(pukcabConfig.OutputDir, module.Name()), nil
+	}
+
+	if err := validateOutputSubdir(instance.OutputSubdir); err != nil {
+		return "", fmt.Errorf("invalid output_subdir: %w", err)
+	}
+	return path.Join(pukcabConfig.OutputDir, instance.OutputSubdir), nil
+}
+
+// MarshallConfig will decode the generic module config in into out, which should be a pointer to the module's config
+// struct. Keys in the config that are not a field of out are rejected.
 func MarshallConfig(in interface{}, out interface{}) error {
 	data, err := json.Marshal(in)
 	if err != nil {
 		return err
 	}
-	if err := json.Unmarshal(data, out); err != nil {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(out); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func directoryExists(dirName string) bool {
+func directoryExists(dirName string) (bool, error) {
 	info, err := os.Stat(dirName)
 	if os.IsNotExist(err) {
-		return false
+		return false, nil
+	}
+	if err != nil {
+		return false, err
 	}
 	if info.IsDir() {
-		return true
+		return true, nil
 	}
-	panic("File found at path when directory wanted")
+	return false, fmt.Errorf("%s is a file, not a directory", dirName)
 }
 
 func makeDirectoryIfNotExists(dirName string) error {
-	if !directoryExists(dirName) {
+	exists, err := directoryExists(dirName)
+	if err != nil {
+		return err
+	}
+	if !exists {
 		return os.MkdirAll(dirName, os.ModePerm)
 	}
 
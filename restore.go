@@ -0,0 +1,151 @@
+package pukcab
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Restore will copy the artifacts from a saved run of the given module instance to the target directory. runDirName is
+// the name of the run directory to restore from, or an empty string for the most recent run that finished without an
+// error. Each artifact is checked against the size and checksum in the manifest, and existing files in the target
+// directory are never overwritten. Returns the paths of the restored files.
+func Restore(module ContextModule, instance ModuleType, runDirName string, targetDir string) ([]string, error) {
+	runs, err := SavedRuns(module, instance)
+	if err != nil {
+		return nil, err
+	}
+	run, files, err := findRestoreRun(runs, instance, runDirName)
+	if err != nil {
+		return nil, err
+	}
+	return restoreRun(run, files, targetDir, func(dir string, name string, w io.Writer) error {
+		f, err := os.Open(path.Join(dir, name))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(w, f)
+		return err
+	})
+}
+
+// RestoreFrom will copy the artifacts from a run of the given module instance that was saved to the destination,
+// in the same way as Restore
+func RestoreFrom(ctx context.Context, destination OpenDestination, module ContextModule, instance ModuleType, runDirName string, targetDir string) ([]string, error) {
+	runs, err := DestinationRuns(ctx, destination, module, instance)
+	if err != nil {
+		return nil, err
+	}
+	run, files, err := findRestoreRun(runs, instance, runDirName)
+	if err != nil {
+		return nil, err
+	}
+	return restoreRun(run, files, targetDir, func(dir string, name string, w io.Writer) error {
+		return destination.Get(ctx, dir+"/"+filepath.ToSlash(name), w)
+	})
+}
+
+// restoreRun will copy each of the files of the run to the target directory, using get to read the file with the given
+// name from the given run directory
+func restoreRun(run *SavedRun, files []previousArtifact, targetDir string, get func(dir string, name string, w io.Writer) error) ([]string, error) {
+	if err := makeDirectoryIfNotExists(targetDir); err != nil {
+		return nil, err
+	}
+
+	restored := []string{}
+	for _, f := range files {
+		file := f.File
+		// Manifests may come from a destination, so a name must never lead outside of the target directory
+		name := path.Clean(filepath.ToSlash(file.Name))
+		if path.IsAbs(name) || name == "." || name == ".." || strings.HasPrefix(name, "../") {
+			log.PError("Not restoring artifact with a path outside of the target directory", map[string]interface{}{
+				"instance":  run.Instance,
+				"file_path": file.Name,
+			})
+			return restored, fmt.Errorf("%s: artifact name is not a path inside of the run directory", file.Name)
+		}
+		targetPath := path.Join(targetDir, name)
+		if err := restoreFile(targetPath, file, func(name string, w io.Writer) error {
+			return get(f.Dir, name, w)
+		}); err != nil {
+			log.PError("Error restoring artifact", map[string]interface{}{
+				"instance":  run.Instance,
+				"file_path": file.Name,
+				"error":     err.Error(),
+			})
+			return restored, fmt.Errorf("%s: %w", file.Name, err)
+		}
+		log.PInfo("Restored artifact", map[string]interface{}{
+			"instance":    run.Instance,
+			"file_path":   file.Name,
+			"target_path": targetPath,
+		})
+		restored = append(restored, targetPath)
+	}
+	return restored, nil
+}
+
+// findRestoreRun returns the saved run to restore from and its files
+func findRestoreRun(runs []SavedRun, instance ModuleType, runDirName string) (*SavedRun, []previousArtifact, error) {
+	for i := len(runs) - 1; i >= 0; i-- {
+		run := runs[i]
+		if runDirName != "" {
+			if path.Base(run.Dir) == runDirName {
+				return &run, runArtifacts(runs, i, instance), nil
+			}
+			continue
+		}
+		if !run.OK() {
+			continue
+		}
+		if files := runArtifacts(runs, i, instance); len(files) > 0 {
+			return &run, files, nil
+		}
+	}
+	if runDirName != "" {
+		return nil, nil, fmt.Errorf("no run of %s found in %s", instance.Label(), runDirName)
+	}
+	return nil, nil, fmt.Errorf("no successful run of %s found", instance.Label())
+}
+
+// restoreFile will copy an artifact to targetPath, removing the copy if it does not match the manifest
+func restoreFile(targetPath string, file ManifestFile, get func(name string, w io.Writer) error) error {
+	if err := makeDirectoryIfNotExists(path.Dir(targetPath)); err != nil {
+		return err
+	}
+	target, err := os.OpenFile(targetPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	counter := &countingWriter{}
+	err = get(file.Name, io.MultiWriter(target, h, counter))
+	if closeErr := target.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && (counter.n != file.Size || hex.EncodeToString(h.Sum(nil)) != file.SHA256) {
+		err = fmt.Errorf("artifact does not match the manifest")
+	}
+	if err != nil {
+		os.Remove(targetPath)
+		return err
+	}
+	return nil
+}
+
+// countingWriter counts the number of bytes written to it
+type countingWriter struct {
+	n uint64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += uint64(len(p))
+	return len(p), nil
+}
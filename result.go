@@ -0,0 +1,82 @@
+package pukcab
+
+import (
+	"time"
+)
+
+// RunResult describes the outcome of running a module
+type RunResult struct {
+	// The name of the module that was run
+	ModuleName string
+	// The label of the module instance that was run
+	Instance string
+	// The directory where artifacts for this run were saved
+	Dir string
+	// When the module started
+	Start time.Time
+	// When the module finished
+	End time.Time
+	// Artifacts that were saved
+	Artifacts []Artifact
+	// Artifacts produced by the module that were discarded
+	Discarded []DiscardedArtifact
+	// Artifacts produced by the module that were not kept because they were unchanged since the previous run
+	Skipped []Artifact
+	// The error returned by the module, if any
+	Error error
+	// True if this was a dry run, where artifacts were planned but not saved
+	DryRun bool
+	// Artifacts that the module would have saved, only set for dry runs
+	Planned []PlannedArtifact
+	// Run directories that were removed, or would have been removed for dry runs, by the retention policy
+	Expired []string
+	// What happened at each destination
+	Destinations []DestinationResult
+
+	// The keys uploaded to each destination by upload processors, keyed by destination label
+	uploaded map[string][]string
+	// The first error from upload processors for each destination, keyed by destination label
+	uploadErrors map[string]error
+}
+
+// Artifact describes a backup artifact that was saved
+type Artifact struct {
+	Path   string
+	Size   uint64
+	SHA256 string
+	Source string
+	// How the artifact was encrypted, if it was
+	Encryption *ArtifactEncryption
+	// The names of the processors that were applied to the artifact, in order
+	Processors []string
+	// Set by change detection if the artifact is identical to the previous copy of the artifact
+	Unchanged bool
+	// Set by change detection if the artifact differs from the previous copy of the artifact, or if there was no
+	// previous copy
+	Changed bool
+}
+
+// DiscardedArtifact describes a backup artifact that was produced by a module but was not saved
+type DiscardedArtifact struct {
+	Path   string
+	Reason string
+}
+
+// Failed returns true if the module returned an error, if any artifact it produced was discarded, or if the artifacts
+// could not be saved to a destination
+func (r RunResult) Failed() bool {
+	if r.Error != nil || len(r.Discarded) > 0 {
+		return true
+	}
+	for _, destination := range r.Destinations {
+		if destination.Error != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Duration returns how long the module took to run
+func (r RunResult) Duration() time.Duration {
+	return r.End.Sub(r.Start)
+}
@@ -0,0 +1,165 @@
+package pukcab
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"time"
+)
+
+// RetentionPolicy describes which backup runs should be kept when cleaning up expired artifacts. A run is kept if any
+// of the rules select it. If no rules are set then all runs are kept.
+type RetentionPolicy struct {
+	// Keep all runs from the last N days
+	Days int `json:"days"`
+	// Keep the most recent run from each of the last N days that had a run
+	Daily int `json:"daily"`
+	// Keep the most recent run from each of the last N weeks that had a run
+	Weekly int `json:"weekly"`
+	// Keep the most recent run from each of the last N months that had a run
+	Monthly int `json:"monthly"`
+	// Keep the most recent run from each of the last N years that had a run
+	Yearly int `json:"yearly"`
+}
+
+// IsEmpty returns true if this policy has no rules, meaning that all runs are kept
+func (p RetentionPolicy) IsEmpty() bool {
+	return p.Days <= 0 && p.Daily <= 0 && p.Weekly <= 0 && p.Monthly <= 0 && p.Yearly <= 0
+}
+
+func (p RetentionPolicy) String() string {
+	return fmt.Sprintf("days=%d daily=%d weekly=%d monthly=%d yearly=%d", p.Days, p.Daily, p.Weekly, p.Monthly, p.Yearly)
+}
+
+// runDatePattern matches the date portion of a run directory name
+var runDatePattern = regexp.MustCompile("[0-9]{4}-[0-9]{2}-[0-9]{2}")
+
+// runDirDate returns the date of the run directory with the given name, or false if the name does not include a date
+func runDirDate(name string) (time.Time, bool) {
+	dateStr := runDatePattern.FindString(name)
+	if dateStr == "" {
+		return time.Time{}, false
+	}
+	date, err := time.Parse("2006-01-02", dateStr)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return date, true
+}
+
+// Expired returns the names of the run directories that are not kept by this policy. Directory names that do not
+// include a date are never expired.
+//
+// Only run directories for which hasArtifacts returns true, such as those of successful runs, count toward the daily,
+// weekly, monthly, and yearly rules, and the newest of them is always kept. Run directories without artifacts are
+// kept if they are newer than the oldest kept run directory with artifacts. If hasArtifacts is nil then every run
+// directory is treated as having artifacts.
+func (p RetentionPolicy) Expired(runDirs []string, hasArtifacts func(runDir string) bool) []string {
+	if p.IsEmpty() {
+		return nil
+	}
+
+	type run struct {
+		name         string
+		date         time.Time
+		hasArtifacts bool
+	}
+	runs := []run{}
+	for _, name := range runDirs {
+		date, ok := runDirDate(name)
+		if !ok {
+			continue
+		}
+		runs = append(runs, run{name, date, hasArtifacts == nil || hasArtifacts(name)})
+	}
+
+	// Newest first. Directory names sort chronologically for runs on the same date.
+	sort.Slice(runs, func(i, j int) bool {
+		if runs[i].date.Equal(runs[j].date) {
+			return runs[i].name > runs[j].name
+		}
+		return runs[i].date.After(runs[j].date)
+	})
+
+	keep := map[string]bool{}
+	keepNewestPer := func(n int, period func(date time.Time) string) {
+		seen := map[string]bool{}
+		for _, r := range runs {
+			if len(seen) >= n {
+				return
+			}
+			if !r.hasArtifacts {
+				continue
+			}
+			key := period(r.date)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			keep[r.name] = true
+		}
+	}
+
+	if p.Days > 0 {
+		retentionHours := float64(p.Days) * 24.0
+		for _, r := range runs {
+			if time.Since(r.date).Hours() <= retentionHours {
+				keep[r.name] = true
+			}
+		}
+	}
+	keepNewestPer(p.Daily, func(date time.Time) string {
+		return date.Format("2006-01-02")
+	})
+	keepNewestPer(p.Weekly, func(date time.Time) string {
+		year, week := date.ISOWeek()
+		return fmt.Sprintf("%d-%d", year, week)
+	})
+	keepNewestPer(p.Monthly, func(date time.Time) string {
+		return date.Format("2006-01")
+	})
+	keepNewestPer(p.Yearly, func(date time.Time) string {
+		return date.Format("2006")
+	})
+	// Never leave a module without its most recent backup
+	for _, r := range runs {
+		if r.hasArtifacts {
+			keep[r.name] = true
+			break
+		}
+	}
+
+	// Runs are newest first, so runs without artifacts are kept until the oldest kept run with artifacts
+	oldestKept := -1
+	for i, r := range runs {
+		if r.hasArtifacts && keep[r.name] {
+			oldestKept = i
+		}
+	}
+	expired := []string{}
+	for i, r := range runs {
+		if !r.hasArtifacts && i < oldestKept {
+			continue
+		}
+		if !keep[r.name] {
+			expired = append(expired, r.name)
+		}
+	}
+	return expired
+}
+
+// retentionPolicy returns the retention policy that applies to the given module instance
+func retentionPolicy(instance ModuleType) RetentionPolicy {
+	return configRetentionPolicy(*pukcabConfig, instance)
+}
+
+// configRetentionPolicy returns the retention policy that applies to the given module instance in the given config
+func configRetentionPolicy(config Config, instance ModuleType) RetentionPolicy {
+	if instance.Retention != nil {
+		return *instance.Retention
+	}
+	if config.Retention != nil {
+		return *config.Retention
+	}
+	return RetentionPolicy{Days: config.ArtifactRetention}
+}
@@ -0,0 +1,142 @@
+package pukcab
+
+import (
+	"context"
+	"sync"
+)
+
+// HostModule describes an optional interface for modules that connect to a remote host. Modules that implement this
+// interface are subject to the per-host concurrency limit.
+type HostModule interface {
+	// Host returns the name of the host that the module will connect to with the given config, or an empty string if
+	// the host isn't known.
+	Host(c interface{}) string
+}
+
+// Job describes a module instance to run
+type Job struct {
+	Module   ContextModule
+	Instance ModuleType
+	// Destinations that the artifacts are copied to after the module runs
+	Destinations []OpenDestination
+}
+
+// host returns the remote host this job connects to, if known
+func (j Job) host() string {
+	hostModule, ok := j.Module.(HostModule)
+	if !ok {
+		return ""
+	}
+	return hostModule.Host(j.Instance.Config)
+}
+
+// RunJobs will run each job, copy its artifacts to its destinations, and then clean up its expired artifacts. Up to the configured concurrency number of
+// jobs are run at the same time, and no more than the configured host concurrency number of jobs that connect to the
+// same host. Returns the result of each job in the same order as the given jobs.
+func RunJobs(ctx context.Context, jobs []Job) []*RunResult {
+	concurrency := pukcabConfig.Concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	hostConcurrency := pukcabConfig.HostConcurrency
+
+	results := make([]*RunResult, len(jobs))
+	hosts := make([]string, len(jobs))
+	pending := make([]int, len(jobs))
+	for i, job := range jobs {
+		hosts[i] = job.host()
+		pending[i] = i
+	}
+
+	lock := &sync.Mutex{}
+	cond := sync.NewCond(lock)
+	running := 0
+	hostRunning := map[string]int{}
+	wg := &sync.WaitGroup{}
+
+	// nextJob returns the index in pending of the first job that can be started now, or -1
+	nextJob := func() int {
+		if running >= concurrency {
+			return -1
+		}
+		for i, jobIdx := range pending {
+			host := hosts[jobIdx]
+			if host == "" || hostConcurrency <= 0 || hostRunning[host] < hostConcurrency {
+				return i
+			}
+		}
+		return -1
+	}
+
+	for len(pending) > 0 {
+		lock.Lock()
+		i := nextJob()
+		for i == -1 {
+			cond.Wait()
+			i = nextJob()
+		}
+		jobIdx := pending[i]
+		pending = append(pending[:i], pending[i+1:]...)
+		host := hosts[jobIdx]
+		running++
+		hostRunning[host]++
+		lock.Unlock()
+
+		wg.Add(1)
+		go func(jobIdx int, host string) {
+			defer wg.Done()
+			results[jobIdx] = runJob(ctx, jobs[jobIdx])
+
+			lock.Lock()
+			running--
+			hostRunning[host]--
+			cond.Broadcast()
+			lock.Unlock()
+		}(jobIdx, host)
+	}
+
+	wg.Wait()
+	return results
+}
+
+func runJob(ctx context.Context, job Job) *RunResult {
+	result := runModule(ctx, job.Module, job.Instance, job.Destinations)
+	if ctx.Err() != nil {
+		return result
+	}
+
+	for _, destination := range job.Destinations {
+		destinationResult := DestinationResult{Destination: destination.Label}
+		if !result.DryRun {
+			destinationResult = UploadRun(ctx, destination, result)
+		}
+		result.Destinations = append(result.Destinations, destinationResult)
+	}
+
+	expired, err := cleanupModule(job.Module, job.Instance, result.DryRun)
+	if err != nil {
+		log.PError("Error cleaning up module", map[string]interface{}{
+			"module_name": job.Module.Name(),
+			"instance":    job.Instance.Label(),
+			"error":       err.Error(),
+		})
+	}
+	result.Expired = expired
+
+	for i, destination := range job.Destinations {
+		if result.Destinations[i].Error != nil {
+			// Don't remove older copies from a destination that didn't receive this run
+			continue
+		}
+		expired, err := cleanupDestination(ctx, destination, job.Module, job.Instance, result.DryRun)
+		if err != nil {
+			log.PError("Error cleaning up destination", map[string]interface{}{
+				"destination": destination.Label,
+				"instance":    job.Instance.Label(),
+				"error":       err.Error(),
+			})
+		}
+		result.Destinations[i].Expired = expired
+	}
+	return result
+}
@@ -0,0 +1,152 @@
+package pukcab
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// Prefixes for secret references in module configs
+const (
+	// The value of an environment variable, for example "env:CLOUDFLARE_API_KEY"
+	SecretPrefixEnv = "env:"
+	// The contents of a file, for example "file:/etc/pukcab/pfsense_password"
+	SecretPrefixFile = "file:"
+	// The output of a shell command, for example "cmd:pass show pfsense"
+	SecretPrefixCmd = "cmd:"
+)
+
+var secretCache = map[string]string{}
+var secretCacheLock = &sync.Mutex{}
+
+// IsSecretReference returns true if the given value is a reference to a secret. Configs are validated before secrets
+// are resolved, so validators should only check that a value that is a secret reference is set, and not its format.
+func IsSecretReference(value string) bool {
+	return strings.HasPrefix(value, SecretPrefixEnv) || strings.HasPrefix(value, SecretPrefixFile) || strings.HasPrefix(value, SecretPrefixCmd)
+}
+
+// ResolveSecrets returns a copy of the given module config where any string values that are secret references are
+// replaced with the value of the secret. Resolved secrets are cached for the life of the process.
+// Errors never include the value of a secret.
+func ResolveSecrets(ctx context.Context, config interface{}) (interface{}, error) {
+	switch c := config.(type) {
+	case map[string]interface{}:
+		resolved := map[string]interface{}{}
+		for k, v := range c {
+			r, err := ResolveSecrets(ctx, v)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", k, err)
+			}
+			resolved[k] = r
+		}
+		return resolved, nil
+	case []interface{}:
+		resolved := make([]interface{}, len(c))
+		for i, v := range c {
+			r, err := ResolveSecrets(ctx, v)
+			if err != nil {
+				return nil, fmt.Errorf("[%d]: %w", i, err)
+			}
+			resolved[i] = r
+		}
+		return resolved, nil
+	case string:
+		if !IsSecretReference(c) {
+			return c, nil
+		}
+		return resolveSecret(ctx, c)
+	}
+	return config, nil
+}
+
+func resolveSecret(ctx context.Context, reference string) (string, error) {
+	secretCacheLock.Lock()
+	defer secretCacheLock.Unlock()
+
+	if value, ok := secretCache[reference]; ok {
+		return value, nil
+	}
+
+	var value string
+	switch {
+	case strings.HasPrefix(reference, SecretPrefixEnv):
+		name := strings.TrimPrefix(reference, SecretPrefixEnv)
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("secret %s: environment variable is not set", reference)
+		}
+		value = v
+	case strings.HasPrefix(reference, SecretPrefixFile):
+		data, err := os.ReadFile(strings.TrimPrefix(reference, SecretPrefixFile))
+		if err != nil {
+			return "", fmt.Errorf("secret %s: %w", reference, err)
+		}
+		value = strings.TrimRight(string(data), "\r\n")
+	case strings.HasPrefix(reference, SecretPrefixCmd):
+		command := exec.CommandContext(ctx, "/bin/sh", "-c", strings.TrimPrefix(reference, SecretPrefixCmd))
+		command.Stderr = os.Stderr
+		output, err := command.Output()
+		if err != nil {
+			return "", fmt.Errorf("secret %s: %w", reference, err)
+		}
+		value = strings.TrimRight(string(output), "\r\n")
+	}
+
+	log.PDebug("Resolved secret", map[string]interface{}{
+		"reference": reference,
+	})
+	secretCache[reference] = value
+	return value, nil
+}
+
+// RedactSecrets returns s with the value of any resolved secrets replaced. Modules should use this before logging or
+// returning values from their config that may have been secret references.
+func RedactSecrets(s string) string {
+	secretCacheLock.Lock()
+	defer secretCacheLock.Unlock()
+
+	for _, value := range secretCache {
+		// Very short values are likely to appear by chance
+		if len(value) < 3 {
+			continue
+		}
+		s = strings.ReplaceAll(s, value, "[REDACTED]")
+	}
+	return s
+}
+
+// redactError returns err, or a new error without the value of any resolved secrets if the message of err contained any
+func redactError(err error) error {
+	redacted := RedactSecrets(err.Error())
+	if redacted == err.Error() {
+		return err
+	}
+	return errors.New(redacted)
+}
+
+// validateSecretReferences returns an error for any secret references in the given module config that are malformed.
+// Secrets are not resolved.
+func validateSecretReferences(label string, config interface{}) ConfigErrors {
+	errs := ConfigErrors{}
+	switch c := config.(type) {
+	case map[string]interface{}:
+		for k, v := range c {
+			errs = append(errs, validateSecretReferences(label+"."+k, v)...)
+		}
+	case []interface{}:
+		for i, v := range c {
+			errs = append(errs, validateSecretReferences(fmt.Sprintf("%s[%d]", label, i), v)...)
+		}
+	case string:
+		for _, prefix := range []string{SecretPrefixEnv, SecretPrefixFile, SecretPrefixCmd} {
+			if c == prefix {
+				errs = append(errs, fmt.Errorf("%s: secret reference '%s' is missing a value", label, c))
+			}
+		}
+	}
+	return errs
+}
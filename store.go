@@ -0,0 +1,151 @@
+package pukcab
+
+import (
+	"encoding/hex"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// StoreDirName is the name of the directory in the output directory where deduplicated artifacts are stored by their
+// SHA-256 checksum
+const StoreDirName = ".store"
+
+// isChecksum returns true if s is a hex encoded SHA-256 checksum, and so is safe to use in a path
+func isChecksum(s string) bool {
+	b, err := hex.DecodeString(s)
+	return err == nil && len(b) == 32
+}
+
+// storePath returns the path of the artifact with the given checksum in the store
+func storePath(checksum string) string {
+	return path.Join(pukcabConfig.OutputDir, StoreDirName, checksum[:2], checksum)
+}
+
+// deduplicateArtifact will replace the artifact with a hard link to the identical artifact in the store, or add the
+// artifact to the store if there isn't one. Returns true if the artifact was replaced.
+func deduplicateArtifact(artifact Artifact) (bool, error) {
+	if !isChecksum(artifact.SHA256) || artifact.Size == 0 {
+		return false, nil
+	}
+	storedPath := storePath(artifact.SHA256)
+
+	storedInfo, err := os.Stat(storedPath)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	if err == nil {
+		artifactInfo, err := os.Stat(artifact.Path)
+		if err != nil {
+			return false, err
+		}
+		if os.SameFile(storedInfo, artifactInfo) {
+			return false, nil
+		}
+		// Never link to a stored artifact that has been altered since it was stored
+		if checksum, err := hashFile(storedPath); err == nil && checksum == artifact.SHA256 && uint64(storedInfo.Size()) == artifact.Size {
+			if err := replaceWithLink(storedPath, artifact.Path); err != nil {
+				return false, err
+			}
+			return true, nil
+		}
+		log.PWarn("Stored artifact does not match its checksum, replacing it", map[string]interface{}{
+			"store_path": storedPath,
+		})
+	}
+
+	if err := makeDirectoryIfNotExists(path.Dir(storedPath)); err != nil {
+		return false, err
+	}
+	return false, replaceWithLink(artifact.Path, storedPath)
+}
+
+// replaceWithLink will create a hard link to oldPath at newPath, replacing anything at newPath. The link is created
+// with a temporary name and then renamed into place so that newPath is never missing.
+func replaceWithLink(oldPath string, newPath string) error {
+	tmpPath, err := TempPath(newPath)
+	if err != nil {
+		return err
+	}
+	if err := os.Link(oldPath, tmpPath); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, newPath); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
+
+// manifestChecksums returns the checksums of every artifact listed in the manifest of the run directory
+func manifestChecksums(runDir string) []string {
+	manifest, err := ReadManifest(runDir)
+	if err != nil {
+		return nil
+	}
+	checksums := []string{}
+	for _, run := range manifest.Runs {
+		for _, file := range run.Files {
+			checksums = append(checksums, file.SHA256)
+		}
+	}
+	return checksums
+}
+
+// cleanupStore will remove the artifacts with the given checksums from the store if they are no longer listed in any
+// manifest in the output directory. Artifacts in run directories are hard links to the stored copy, so removing a
+// stored artifact never removes the data of an artifact that still exists.
+func cleanupStore(checksums []string) {
+	storeDir := path.Join(pukcabConfig.OutputDir, StoreDirName)
+	if exists, _ := directoryExists(storeDir); !exists || len(checksums) == 0 {
+		return
+	}
+
+	referenced := map[string]bool{}
+	err := filepath.WalkDir(pukcabConfig.OutputDir, func(dirPath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if dirPath == storeDir {
+			return fs.SkipDir
+		}
+		if _, err := os.Stat(path.Join(dirPath, ManifestFileName)); err != nil {
+			return nil
+		}
+		for _, checksum := range manifestChecksums(dirPath) {
+			referenced[checksum] = true
+		}
+		return fs.SkipDir
+	})
+	if err != nil {
+		log.PError("Error reading manifests, not cleaning up store", map[string]interface{}{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	for _, checksum := range checksums {
+		if referenced[checksum] || !isChecksum(checksum) {
+			continue
+		}
+		storedPath := storePath(checksum)
+		if err := os.Remove(storedPath); err != nil {
+			if !os.IsNotExist(err) {
+				log.PError("Error removing unreferenced artifact from store", map[string]interface{}{
+					"store_path": storedPath,
+					"error":      err.Error(),
+				})
+			}
+			continue
+		}
+		log.PDebug("Removed unreferenced artifact from store", map[string]interface{}{
+			"store_path": storedPath,
+		})
+		// Only removed if it is now empty
+		os.Remove(path.Dir(storedPath))
+	}
+}
@@ -0,0 +1,100 @@
+package pukcab
+
+import (
+	"regexp"
+)
+
+// variablePattern matches a ${name} variable reference, or a $${name} escaped reference
+var variablePattern = regexp.MustCompile(`\$?\$\{([^}]*)\}`)
+
+// expandModules will merge the module defaults into the config of each module and replace any ${name} references to
+// variables in module, destination, and processor configs with the value of the variable
+func (c *Config) expandModules() {
+	interpolateProcessors(c.Processors, c.Vars)
+	for i, module := range c.Modules {
+		config := module.Config
+		if defaults, ok := c.Defaults[module.Name]; ok {
+			config = mergeConfig(defaults, config)
+		}
+		c.Modules[i].Config = interpolateConfig(config, c.Vars)
+		interpolateProcessors(module.Processors, c.Vars)
+	}
+	for i, destination := range c.Destinations {
+		c.Destinations[i].Config = interpolateConfig(destination.Config, c.Vars)
+	}
+}
+
+// interpolateProcessors replaces any variable references in the config of each processor in the pipeline
+func interpolateProcessors(pipeline []ProcessorType, vars map[string]string) {
+	for i, step := range pipeline {
+		pipeline[i].Config = interpolateConfig(step.Config, vars)
+	}
+}
+
+// mergeConfig returns a copy of the defaults with the values from config added. Nested objects are merged, any other
+// values in config replace the default.
+func mergeConfig(defaults interface{}, config interface{}) interface{} {
+	defaultsMap, ok := defaults.(map[string]interface{})
+	if !ok {
+		if config == nil {
+			return defaults
+		}
+		return config
+	}
+	if config == nil {
+		config = map[string]interface{}{}
+	}
+	configMap, ok := config.(map[string]interface{})
+	if !ok {
+		return config
+	}
+
+	merged := map[string]interface{}{}
+	for k, v := range defaultsMap {
+		merged[k] = v
+	}
+	for k, v := range configMap {
+		if d, ok := merged[k]; ok {
+			merged[k] = mergeConfig(d, v)
+		} else {
+			merged[k] = v
+		}
+	}
+	return merged
+}
+
+// interpolateConfig returns a copy of the given config with variable references in all string values replaced
+func interpolateConfig(config interface{}, vars map[string]string) interface{} {
+	switch c := config.(type) {
+	case map[string]interface{}:
+		interpolated := map[string]interface{}{}
+		for k, v := range c {
+			interpolated[k] = interpolateConfig(v, vars)
+		}
+		return interpolated
+	case []interface{}:
+		interpolated := make([]interface{}, len(c))
+		for i, v := range c {
+			interpolated[i] = interpolateConfig(v, vars)
+		}
+		return interpolated
+	case string:
+		return interpolate(c, vars)
+	}
+	return config
+}
+
+// interpolate replaces all ${name} references in s with the value of the variable. References to names that aren't
+// variables, such as ${HOME} in a command line, are left as they are. $${name} is replaced with a literal ${name}.
+func interpolate(s string, vars map[string]string) string {
+	return variablePattern.ReplaceAllStringFunc(s, func(match string) string {
+		if match[1] == '$' {
+			return match[1:]
+		}
+		name := variablePattern.FindStringSubmatch(match)[1]
+		if value, ok := vars[name]; ok {
+			return value
+		}
+		return match
+	})
+}
@@ -0,0 +1,251 @@
+package pukcab
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Validator describes an optional interface for modules that can check their config before being run.
+// Validate must not make any network connections or otherwise change anything.
+type Validator interface {
+	Validate(c interface{}) error
+}
+
+// FieldError describes a problem with a single field in a config
+type FieldError struct {
+	// The name of the module or section of the config
+	Module string
+	// The name of the field, as it appears in the config file
+	Field string
+	// A description of the problem, such as "is required"
+	Message string
+}
+
+func (e FieldError) Error() string {
+	return e.Module + ": " + e.Field + " " + e.Message
+}
+
+// RequiredField returns a FieldError for a required field that was not set
+func RequiredField(module, field string) FieldError {
+	return FieldError{
+		Module:  module,
+		Field:   field,
+		Message: "is required",
+	}
+}
+
+// ConfigErrors describes all of the problems found with a config
+type ConfigErrors []error
+
+func (e ConfigErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "; ")
+}
+
+// Err returns nil if there are no errors, otherwise returns e
+func (e ConfigErrors) Err() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+// ValidateConfig will check the given config for problems without running any modules. Modules and destination
+// providers are looked up by name in the given maps, and are validated if they implement the Validator interface.
+// Returns a ConfigErrors if any problems were found.
+func ValidateConfig(config Config, modules map[string]ContextModule, destinations map[string]DestinationProvider) error {
+	errs := ConfigErrors{}
+
+	if config.OutputDir == "" {
+		errs = append(errs, RequiredField("config", "output_dir"))
+	}
+	switch config.RunLayout {
+	case "", RunLayoutDate, RunLayoutDateTime, RunLayoutRunID:
+	default:
+		errs = append(errs, FieldError{"config", "run_layout", fmt.Sprintf("'%s' is not a known layout", config.RunLayout)})
+	}
+	if config.Timeout != "" {
+		if _, err := parseTimeout(config.Timeout); err != nil {
+			errs = append(errs, FieldError{"config", "timeout", "is not a valid duration"})
+		}
+	}
+	if config.Concurrency < 0 {
+		errs = append(errs, FieldError{"config", "concurrency", "must not be negative"})
+	}
+	if config.HostConcurrency < 0 {
+		errs = append(errs, FieldError{"config", "host_concurrency", "must not be negative"})
+	}
+	if config.Retention != nil {
+		errs = append(errs, validateRetention("config", *config.Retention)...)
+	}
+	if config.Encryption != nil {
+		errs = append(errs, validateEncryption("config", "encryption.", *config.Encryption)...)
+	}
+	if config.Compression != nil {
+		errs = append(errs, validateCompression("config", "compression.", *config.Compression)...)
+	}
+	if config.ChangeDetection != nil {
+		errs = append(errs, validateChangeDetection("config", *config.ChangeDetection)...)
+	}
+
+	// Upload processors can refer to any destination in the config
+	configuredDestinations := map[string]bool{}
+	for _, destination := range config.Destinations {
+		configuredDestinations[destination.Label()] = true
+	}
+	errs = append(errs, validateProcessors("config", config.Processors, configuredDestinations)...)
+
+	defaultNames := make([]string, 0, len(config.Defaults))
+	for name := range config.Defaults {
+		defaultNames = append(defaultNames, name)
+	}
+	sort.Strings(defaultNames)
+	for _, name := range defaultNames {
+		if _, ok := modules[name]; !ok {
+			errs = append(errs, FieldError{"config", "defaults", fmt.Sprintf("'%s' is not a known module", name)})
+		}
+	}
+
+	ids := map[string]bool{}
+	// Instances that share an output directory also share its runs, so they must agree on which runs expire
+	outputDirs := map[string]ModuleType{}
+	for i, instance := range config.Modules {
+		label := fmt.Sprintf("modules[%d]", i)
+		if instance.ID != "" {
+			label = instance.ID
+			if ids[instance.ID] {
+				errs = append(errs, FieldError{label, "id", "is used by more than one module"})
+			}
+			ids[instance.ID] = true
+		}
+
+		module, ok := modules[instance.Name]
+		if !ok {
+			errs = append(errs, FieldError{label, "name", fmt.Sprintf("'%s' is not a known module", instance.Name)})
+			continue
+		}
+		outputSubdir := instance.Name
+		if instance.OutputSubdir != "" {
+			outputSubdir = path.Clean(instance.OutputSubdir)
+			if err := validateOutputSubdir(instance.OutputSubdir); err != nil {
+				errs = append(errs, FieldError{label, "output_subdir", "must be a relative path inside of the output directory"})
+			} else if outputSubdir == StoreDirName || strings.HasPrefix(outputSubdir, StoreDirName+"/") {
+				errs = append(errs, FieldError{label, "output_subdir", fmt.Sprintf("must not be inside of the %s directory", StoreDirName)})
+			}
+		}
+		if other, ok := outputDirs[outputSubdir]; ok {
+			if configRetentionPolicy(config, other) != configRetentionPolicy(config, instance) {
+				errs = append(errs, FieldError{label, "output_subdir", fmt.Sprintf("'%s' is also used by %s with a different retention policy, set a different output_subdir", outputSubdir, other.Label())})
+			}
+		} else {
+			outputDirs[outputSubdir] = instance
+		}
+		if instance.Timeout != "" {
+			if _, err := parseTimeout(instance.Timeout); err != nil {
+				errs = append(errs, FieldError{label, "timeout", "is not a valid duration"})
+			}
+		}
+		if instance.Retention != nil {
+			errs = append(errs, validateRetention(label, *instance.Retention)...)
+		}
+		if instance.Encryption != nil {
+			errs = append(errs, validateEncryption(label, "encryption.", *instance.Encryption)...)
+		}
+		if instance.Compression != nil {
+			errs = append(errs, validateCompression(label, "compression.", *instance.Compression)...)
+		}
+		if instance.ChangeDetection != nil {
+			errs = append(errs, validateChangeDetection(label, *instance.ChangeDetection)...)
+		}
+		errs = append(errs, validateProcessors(label, instance.Processors, configuredDestinations)...)
+		for _, tag := range instance.Tags {
+			if tag == "" || strings.ContainsAny(tag, ", \t=") {
+				errs = append(errs, FieldError{label, "tags", fmt.Sprintf("'%s' is not a valid tag, tags must not be empty or contain commas, spaces, or '='", tag)})
+			}
+		}
+
+		errs = append(errs, validateSecretReferences(label+".config", instance.Config)...)
+
+		validator, ok := module.(Validator)
+		if !ok {
+			continue
+		}
+		if err := validator.Validate(instance.Config); err != nil {
+			if moduleErrs, ok := err.(ConfigErrors); ok {
+				for _, moduleErr := range moduleErrs {
+					errs = append(errs, fmt.Errorf("%s: %w", label, moduleErr))
+				}
+			} else {
+				errs = append(errs, fmt.Errorf("%s: %w", label, err))
+			}
+		}
+	}
+
+	destinationLabels := map[string]bool{}
+	for i, destination := range config.Destinations {
+		label := fmt.Sprintf("destinations[%d]", i)
+		if destination.ID != "" {
+			label = "destination " + destination.ID
+		}
+		if destinationLabels[destination.Label()] {
+			errs = append(errs, FieldError{label, "id", "is used by more than one destination"})
+		}
+		destinationLabels[destination.Label()] = true
+
+		provider, ok := destinations[destination.Name]
+		if !ok {
+			errs = append(errs, FieldError{label, "name", fmt.Sprintf("'%s' is not a known destination", destination.Name)})
+			continue
+		}
+		if destination.Retention != nil {
+			errs = append(errs, validateRetention(label, *destination.Retention)...)
+		}
+		errs = append(errs, validateSecretReferences(label+".config", destination.Config)...)
+
+		validator, ok := provider.(Validator)
+		if !ok {
+			continue
+		}
+		if err := validator.Validate(destination.Config); err != nil {
+			if providerErrs, ok := err.(ConfigErrors); ok {
+				for _, providerErr := range providerErrs {
+					errs = append(errs, fmt.Errorf("%s: %w", label, providerErr))
+				}
+			} else {
+				errs = append(errs, fmt.Errorf("%s: %w", label, err))
+			}
+		}
+	}
+
+	return errs.Err()
+}
+
+func validateRetention(label string, policy RetentionPolicy) ConfigErrors {
+	errs := ConfigErrors{}
+	if policy.Days < 0 || policy.Daily < 0 || policy.Weekly < 0 || policy.Monthly < 0 || policy.Yearly < 0 {
+		errs = append(errs, FieldError{label, "retention", "must not be negative"})
+	}
+	return errs
+}
+
+func validateOutputSubdir(subdir string) error {
+	cleaned := path.Clean(subdir)
+	if path.IsAbs(cleaned) || cleaned == "." || cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return fmt.Errorf("'%s' must be a relative path inside of the output directory", subdir)
+	}
+	return nil
+}
+
+func parseTimeout(timeout string) (time.Duration, error) {
+	d, err := time.ParseDuration(timeout)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid timeout '%s'", timeout)
+	}
+	return d, nil
+}
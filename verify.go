@@ -0,0 +1,177 @@
+package pukcab
+
+import (
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// VerifyReport describes the result of verifying the artifacts of a module
+type VerifyReport struct {
+	// The name of the module
+	Module string
+	// The number of artifacts that were checked
+	Checked int
+	// Artifacts listed in a manifest that no longer exist
+	Missing []string
+	// Artifacts whose size or checksum no longer matches the manifest
+	Altered []string
+	// Files in a run directory that are not listed in its manifest
+	Orphaned []string
+}
+
+// OK returns true if no problems were found with any artifacts
+func (r VerifyReport) OK() bool {
+	return len(r.Missing) == 0 && len(r.Altered) == 0 && len(r.Orphaned) == 0
+}
+
+// Verify will check every artifact recorded in the manifests under the output directory against the size and checksum
+// recorded when it was saved. Returns a report for each module, sorted by module name.
+func Verify() ([]*VerifyReport, error) {
+	reports := map[string]*VerifyReport{}
+	getReport := func(module string) *VerifyReport {
+		report, ok := reports[module]
+		if !ok {
+			report = &VerifyReport{Module: module}
+			reports[module] = report
+		}
+		return report
+	}
+
+	err := filepath.WalkDir(pukcabConfig.OutputDir, func(dirPath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if dirPath == path.Join(pukcabConfig.OutputDir, StoreDirName) {
+			// Stored artifacts are checked through the run directories that link to them
+			return fs.SkipDir
+		}
+
+		manifest, err := ReadManifest(dirPath)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				log.PError("Error reading manifest", map[string]interface{}{
+					"run_dir": dirPath,
+					"error":   err.Error(),
+				})
+				return err
+			}
+			if _, ok := runDirDate(d.Name()); !ok || dirPath == pukcabConfig.OutputDir {
+				return nil
+			}
+			// A run directory without a manifest can't be checked, so any files in it are reported as orphaned rather
+			// than letting a removed manifest hide changes to its artifacts
+			log.PError("Run directory has no manifest", map[string]interface{}{
+				"run_dir": dirPath,
+			})
+			verifyRunDir(dirPath, &Manifest{}, getReport)
+			return fs.SkipDir
+		}
+		verifyRunDir(dirPath, manifest, getReport)
+		return fs.SkipDir
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sorted := make([]*VerifyReport, 0, len(reports))
+	for _, report := range reports {
+		sort.Strings(report.Missing)
+		sort.Strings(report.Altered)
+		sort.Strings(report.Orphaned)
+		sorted = append(sorted, report)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Module < sorted[j].Module
+	})
+	return sorted, nil
+}
+
+func verifyRunDir(runDir string, manifest *Manifest, getReport func(module string) *VerifyReport) {
+	type expectedFile struct {
+		module string
+		file   ManifestFile
+	}
+
+	// Later runs in the same directory replace any artifacts with the same name
+	expected := map[string]expectedFile{}
+	for _, run := range manifest.Runs {
+		for _, file := range run.Files {
+			filePath := file.Name
+			if !path.IsAbs(filePath) {
+				filePath = path.Join(runDir, filePath)
+			}
+			expected[filePath] = expectedFile{run.Module, file}
+		}
+	}
+
+	for filePath, e := range expected {
+		report := getReport(e.module)
+		report.Checked++
+
+		info, err := os.Stat(filePath)
+		if err != nil {
+			log.PError("Artifact missing", map[string]interface{}{
+				"module":    e.module,
+				"file_path": filePath,
+				"error":     err.Error(),
+			})
+			report.Missing = append(report.Missing, filePath)
+			continue
+		}
+		if uint64(info.Size()) != e.file.Size {
+			log.PError("Artifact size does not match manifest", map[string]interface{}{
+				"module":        e.module,
+				"file_path":     filePath,
+				"expected_size": e.file.Size,
+				"actual_size":   info.Size(),
+			})
+			report.Altered = append(report.Altered, filePath)
+			continue
+		}
+		checksum, err := hashFile(filePath)
+		if err != nil || checksum != e.file.SHA256 {
+			log.PError("Artifact checksum does not match manifest", map[string]interface{}{
+				"module":          e.module,
+				"file_path":       filePath,
+				"expected_sha256": e.file.SHA256,
+				"actual_sha256":   checksum,
+			})
+			report.Altered = append(report.Altered, filePath)
+			continue
+		}
+		log.PDebug("Artifact verified", map[string]interface{}{
+			"module":    e.module,
+			"file_path": filePath,
+		})
+	}
+
+	module := path.Base(path.Dir(runDir))
+	if len(manifest.Runs) > 0 {
+		module = manifest.Runs[0].Module
+	}
+	filepath.WalkDir(runDir, func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		if filePath == path.Join(runDir, ManifestFileName) || strings.HasSuffix(filePath, ".tmp") {
+			return nil
+		}
+		if _, ok := expected[filePath]; ok {
+			return nil
+		}
+		log.PWarn("Orphaned file in run directory", map[string]interface{}{
+			"module":    module,
+			"file_path": filePath,
+		})
+		report := getReport(module)
+		report.Orphaned = append(report.Orphaned, filePath)
+		return nil
+	})
+}